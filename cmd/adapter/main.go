@@ -4,11 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/TV4/graceful"
 	gorilla "github.com/gorilla/handlers"
 	"github.com/namsral/flag"
+	"github.com/pwillie/prometheus-es-adapter/pkg/backfill"
 	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"github.com/pwillie/prometheus-es-adapter/pkg/export"
 	"github.com/pwillie/prometheus-es-adapter/pkg/handlers"
 	"github.com/pwillie/prometheus-es-adapter/pkg/logger"
 	"go.uber.org/zap"
@@ -38,11 +43,74 @@ func main() {
 		indexMaxAge   = flag.String("es_index_max_age", "7d", "Max age of Elasticsearch index before rollover")
 		indexMaxDocs  = flag.Int64("es_index_max_docs", 1000000, "Max number of docs in Elasticsearch index before rollover")
 		indexMaxSize  = flag.String("es_index_max_size", "", "Max size of index before rollover eg 5gb")
+		writeOpType   = flag.String("es_write_op_type", "index", "Bulk operation used to write samples, index overwrites resent samples and create keeps the first write")
+		maxSampleAge  = flag.Duration("write_max_sample_age", 0, "Reject samples older than this, 0 accepts any age")
+		maxSampleFut  = flag.Duration("write_max_sample_future", 0, "Reject samples more than this ahead of now, 0 accepts any timestamp")
+		tenantHeader  = flag.String("write_tenant_header", "X-Scope-OrgID", "Header identifying the tenant of write requests for rate limiting, defaults to the client address")
+		samplesRate   = flag.Float64("write_samples_per_second", 0, "Max samples per second written per tenant, 0 is unlimited")
+		samplesBurst  = flag.Int("write_samples_burst", 100000, "Max burst of samples written per tenant")
+		seriesRate    = flag.Float64("write_series_per_second", 0, "Max series per second written per tenant, 0 is unlimited")
+		seriesBurst   = flag.Int("write_series_burst", 10000, "Max burst of series written per tenant")
+		maxSeries     = flag.Int("write_max_series_per_tenant", 0, "Max active series per tenant, 0 is unlimited")
+		seriesIdle    = flag.Duration("write_series_idle_timeout", time.Hour, "How long after its last sample a series stops counting towards the tenant series limit")
+		seriesState   = flag.String("write_series_state_file", "", "File to persist active series to across restarts")
+		haCluster     = flag.String("ha_cluster_label", "", "Label identifying the cluster of Prometheus HA replicas, empty disables HA deduplication")
+		haReplica     = flag.String("ha_replica_label", "__replica__", "Label identifying the replica within a Prometheus HA cluster")
+		haFailover    = flag.Duration("ha_failover_timeout", 30*time.Second, "How long the elected HA replica may stop writing before failing over")
+		storageMode   = flag.String("es_storage_mode", "index", "Storage mode, index for daily or rollover indices behind es_alias, datastream for a data stream named es_alias or tsds for a time series data stream")
+		tsdsLookBack  = flag.Duration("es_tsds_look_back", 0, "How far before its creation a time series data stream accepts samples, 0 is the Elasticsearch default of 2h")
+		indexProfile  = flag.String("es_index_profile", "default", "Index template profile, default or optimized for storage and scan speed")
+		indexRetain   = flag.Duration("es_index_retention", 0, "Delete indices whose newest sample is older than this, 0 keeps indices forever")
+		routingRules  = flag.String("es_routing_rules", "", "JSON file of rules routing matching series to other aliases")
+		routingKey    = flag.String("es_routing_key", "", "Shard routing of samples, fingerprint or label:<name>, empty routes by document id")
 		searchMaxDocs = flag.Int("es_search_max_docs", 1000, "Max number of docs returned for Elasticsearch search operation")
+		indexRefresh  = flag.Duration("es_index_refresh", time.Minute, "How long index time bounds used to prune searches are cached, 0 searches every index")
+		readWorkers   = flag.Int("read_concurrency", 4, "Max number of Elasticsearch searches executed in parallel for read requests")
+		readSplit     = flag.Duration("read_split_interval", 24*time.Hour, "Split read queries into sub-searches of this length, 0 disables splitting")
+		readMaxSeries = flag.Int("read_max_series", 0, "Max number of series returned per read query, 0 is unlimited")
+		readMaxSample = flag.Int("read_max_samples", 0, "Max number of samples returned per read query, 0 is unlimited")
+		readMaxRange  = flag.Duration("read_max_range", 0, "Max time range of a read query, 0 is unlimited")
+		readTimeout   = flag.Duration("read_timeout", 0, "Timeout of a read query, 0 is unlimited")
+		readTermAfter = flag.Int("read_terminate_after", 0, "Max number of documents collected per shard for a search, 0 is unlimited")
+		cacheMaxBytes = flag.Int64("read_cache_max_bytes", 0, "Max size in bytes of the in-memory read cache, 0 disables caching")
+		cacheDir      = flag.String("read_cache_dir", "", "Directory to persist cached read results to")
+		cacheStep     = flag.Duration("read_cache_step", time.Hour, "Size of the aligned time ranges read results are cached by")
+		cacheMinAge   = flag.Duration("read_cache_min_age", 10*time.Minute, "Age after which data is considered immutable and may be cached")
+		dsEnabled     = flag.Bool("downsample", false, "Enable downsampling of raw samples into rollup indices")
+		dsResolutions = flag.String("downsample_resolutions", "5m,1h", "Comma separated resolutions of the rollup indices")
+		dsDelay       = flag.Duration("downsample_delay", 10*time.Minute, "How long to wait for late samples before rolling them up")
+		dsLookback    = flag.Duration("downsample_lookback", 7*24*time.Hour, "How far back to start downsampling when no rollups exist")
+		dsInterval    = flag.Duration("downsample_interval", 5*time.Minute, "Period between downsampling runs")
+		migrateURL    = flag.String("migrate_target_url", "", "Elasticsearch URL migrated samples are written to, defaults to es_url")
+		migrateUser   = flag.String("migrate_target_user", "", "Elasticsearch User of the migration target, defaults to es_user")
+		migratePass   = flag.String("migrate_target_password", "", "Elasticsearch User Password of the migration target, defaults to es_password")
+		migrateAlias  = flag.String("migrate_target_alias", "", "Alias or data stream migrated samples are written to")
+		migrateDaily  = flag.Bool("migrate_target_daily", false, "Write migrated samples to daily indexes")
+		migrateStore  = flag.String("migrate_target_storage", "index", "Storage mode of the migration target, see es_storage_mode")
+		migrateProf   = flag.String("migrate_target_profile", "default", "Index template profile of the migration target, see es_index_profile")
+		migrateRoute  = flag.String("migrate_target_routing_key", "", "Shard routing of migrated samples, see es_routing_key")
+		migrateSlices = flag.Int("migrate_slices", 4, "Number of sliced scrolls reading samples to migrate in parallel")
+		migrateRate   = flag.Float64("migrate_rate", 0, "Max samples per second migrated, 0 is unlimited")
+		migrateCheck  = flag.String("migrate_checkpoint", "", "File migration progress is saved to and resumed from")
+		backfillRate  = flag.Float64("backfill_rate", 0, "Max samples per second backfilled, 0 is unlimited")
+		backfillCheck = flag.String("backfill_checkpoint", "", "File backfill progress is saved to and resumed from")
+		backfillEvery = flag.Duration("backfill_progress_interval", 10*time.Second, "Period between backfill progress reports")
+		exportMatch   = flag.String("export_selector", "", "Series selector of the exported series eg up{job=\"node\"}")
+		exportStart   = flag.String("export_start", "", "Start of the exported time range, RFC3339 or unix timestamp")
+		exportEnd     = flag.String("export_end", "", "End of the exported time range, RFC3339 or unix timestamp, defaults to now")
+		exportFormat  = flag.String("export_format", "openmetrics", "Export format, openmetrics, csv, parquet or tsdb")
+		exportOutput  = flag.String("export_output", "-", "File to export to, - for stdout, or the directory TSDB blocks are created in")
+		exportBlock   = flag.Duration("export_block_duration", 2*time.Hour, "Time range covered by each exported TSDB block")
 		sniffEnabled  = flag.Bool("es_sniff", false, "Enable Elasticsearch sniffing")
 		statsEnabled  = flag.Bool("stats", true, "Expose Prometheus metrics endpoint")
 		debug         = flag.Bool("debug", false, "Debug logging")
 	)
+	// an optional command precedes the flags
+	var command string
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Parse()
 
 	log := logger.NewLogger(*debug)
@@ -59,62 +127,408 @@ func main() {
 		elastic.SetURL(*url),
 		elastic.SetBasicAuth(*user, *pass),
 		elastic.SetSniff(*sniffEnabled),
+		elastic.SetDecoder(&elasticsearch.Decoder{}),
 	)
 	if err != nil {
 		log.Fatal("Failed to create elastic client", zap.Error(err))
 	}
 	defer client.Stop()
 
-	err = elasticsearch.EnsureIndexTemplate(ctx, client, &elasticsearch.IndexTemplateConfig{
+	var routes []*elasticsearch.RoutingRule
+	if *routingRules != "" {
+		routes, err = elasticsearch.LoadRoutingRules(*routingRules, *indexAlias)
+		if err != nil {
+			log.Fatal("Failed to load routing rules", zap.Error(err))
+		}
+	}
+
+	switch command {
+	case "":
+	case "backfill":
+		// runs once the write service is set up below
+		if flag.NArg() == 0 {
+			log.Fatal("backfill needs TSDB block directories or OpenMetrics files as arguments")
+		}
+	case "export":
+		matchers, err := handlers.ParseSelector(*exportMatch)
+		if err != nil || len(matchers) == 0 {
+			log.Fatal("Invalid or missing export_selector", zap.Error(err))
+		}
+		start, err := handlers.ParseTime(*exportStart)
+		if err != nil || start == 0 {
+			log.Fatal("Invalid or missing export_start", zap.Error(err))
+		}
+		end := time.Now().UnixNano() / int64(time.Millisecond)
+		if *exportEnd != "" {
+			if end, err = handlers.ParseTime(*exportEnd); err != nil {
+				log.Fatal("Invalid export_end", zap.Error(err))
+			}
+		}
+		if err := export.ValidateFormat(*exportFormat); err != nil {
+			log.Fatal("Invalid export_format", zap.Error(err))
+		}
+		// rollup indices are left out whether or not downsampling is
+		// currently enabled
+		resolutions, err := elasticsearch.ParseResolutions(*dsResolutions)
+		if err != nil {
+			log.Fatal("Invalid downsample resolutions", zap.Error(err))
+		}
+		readSvc, err := elasticsearch.NewReadService(log, client, &elasticsearch.ReadConfig{
+			Alias:        *indexAlias,
+			Daily:        *indexDaily,
+			MaxDocs:      *searchMaxDocs,
+			IndexRefresh: *indexRefresh,
+			Concurrency:  *readWorkers,
+			Resolutions:  resolutions,
+			Routes:       routes,
+			RoutingKey:   *routingKey,
+			DocValues:    *indexProfile == elasticsearch.ProfileOptimized,
+			Storage:      *storageMode,
+		})
+		if err != nil {
+			log.Fatal("Unable to create elasticsearch read service:", zap.Error(err))
+		}
+		err = export.Run(ctx, log, readSvc, &export.Config{
+			Matchers:      matchers,
+			Start:         start,
+			End:           end,
+			Format:        *exportFormat,
+			Output:        *exportOutput,
+			BlockDuration: *exportBlock,
+		})
+		if err != nil {
+			log.Fatal("Failed to export samples", zap.Error(err))
+		}
+		return
+	case "migrate-datastream":
+		resolutions, err := elasticsearch.ParseResolutions(*dsResolutions)
+		if err != nil {
+			log.Fatal("Invalid downsample resolutions", zap.Error(err))
+		}
+		err = elasticsearch.MigrateToDataStream(ctx, client, &elasticsearch.DataStreamTemplateConfig{
+			Alias:     *indexAlias,
+			Shards:    *indexShards,
+			Replicas:  *indexReplicas,
+			Storage:   elasticsearch.StorageDataStream,
+			Retention: *indexRetain,
+			MaxAge:    *indexMaxAge,
+			MaxDocs:   *indexMaxDocs,
+			MaxSize:   *indexMaxSize,
+		}, resolutions)
+		if err != nil {
+			log.Fatal("Failed to migrate to data stream", zap.Error(err))
+		}
+		log.Info(fmt.Sprintf("Migrated %s to a data stream, restart with es_storage_mode=datastream", *indexAlias))
+		return
+	case "migrate":
+		if *migrateAlias == "" {
+			log.Fatal("missing migrate_target_alias")
+		}
+		target := client
+		if *migrateURL != "" {
+			if *migrateUser == "" {
+				*migrateUser, *migratePass = *user, *pass
+			}
+			target, err = elastic.NewClient(
+				elastic.SetURL(*migrateURL),
+				elastic.SetBasicAuth(*migrateUser, *migratePass),
+				elastic.SetSniff(*sniffEnabled),
+				elastic.SetDecoder(&elasticsearch.Decoder{}),
+			)
+			if err != nil {
+				log.Fatal("Failed to create migration target client", zap.Error(err))
+			}
+			defer target.Stop()
+		} else if *migrateAlias == *indexAlias {
+			log.Fatal("migrate_target_alias must differ from es_alias on the same cluster")
+		}
+		if err := elasticsearch.ValidateStorage(*migrateStore); err != nil {
+			log.Fatal("Invalid migration target storage mode", zap.Error(err))
+		}
+		if elasticsearch.IsDataStream(*migrateStore) {
+			err = elasticsearch.EnsureDataStreamTemplate(ctx, target, &elasticsearch.DataStreamTemplateConfig{
+				Alias:     *migrateAlias,
+				Shards:    *indexShards,
+				Replicas:  *indexReplicas,
+				Storage:   *migrateStore,
+				Retention: *indexRetain,
+				LookBack:  *tsdsLookBack,
+				MaxAge:    *indexMaxAge,
+				MaxDocs:   *indexMaxDocs,
+				MaxSize:   *indexMaxSize,
+			})
+			if err != nil {
+				log.Fatal("Failed to create data stream template", zap.Error(err))
+			}
+		} else {
+			err = elasticsearch.EnsureIndexTemplate(ctx, target, &elasticsearch.IndexTemplateConfig{
+				Alias:    *migrateAlias,
+				Shards:   *indexShards,
+				Replicas: *indexReplicas,
+				Profile:  *migrateProf,
+			})
+			if err != nil {
+				log.Fatal("Failed to create index template", zap.Error(err))
+			}
+			if !*migrateDaily {
+				_, err = elasticsearch.NewIndexService(ctx, log, target, &elasticsearch.IndexConfig{
+					Alias:   *migrateAlias,
+					MaxAge:  *indexMaxAge,
+					MaxDocs: *indexMaxDocs,
+					MaxSize: *indexMaxSize,
+				})
+				if err != nil {
+					log.Fatal("Failed to create indexer", zap.Error(err))
+				}
+			}
+		}
+		targetSvc, err := elasticsearch.NewWriteService(ctx, log, target, &elasticsearch.WriteConfig{
+			Alias:      *migrateAlias,
+			Daily:      *migrateDaily,
+			MaxAge:     *batchMaxAge,
+			MaxDocs:    *batchMaxDocs,
+			MaxSize:    *batchMaxSize,
+			Workers:    *workers,
+			OpType:     *writeOpType,
+			RoutingKey: *migrateRoute,
+			Storage:    *migrateStore,
+			LookBack:   *tsdsLookBack,
+		})
+		if err != nil {
+			log.Fatal("Unable to create migration target", zap.Error(err))
+		}
+		defer targetSvc.Close()
+		// rollup indices share the prefix of raw indices, so are left out
+		// whether or not downsampling is currently enabled
+		resolutions, err := elasticsearch.ParseResolutions(*dsResolutions)
+		if err != nil {
+			log.Fatal("Invalid downsample resolutions", zap.Error(err))
+		}
+		err = elasticsearch.Migrate(ctx, log, client, targetSvc, &elasticsearch.MigrateConfig{
+			Alias:       *indexAlias,
+			Storage:     *storageMode,
+			DocValues:   *indexProfile == elasticsearch.ProfileOptimized,
+			Resolutions: resolutions,
+			Slices:      *migrateSlices,
+			BatchSize:   *searchMaxDocs,
+			Rate:        *migrateRate,
+			Checkpoint:  *migrateCheck,
+		})
+		if err != nil {
+			log.Fatal("Failed to migrate samples", zap.Error(err))
+		}
+		log.Info(fmt.Sprintf("Migrated %s to %s", *indexAlias, *migrateAlias))
+		return
+	default:
+		log.Fatal(fmt.Sprintf("Unknown command %q", command))
+	}
+
+	targets := []*elasticsearch.RoutingRule{{
 		Alias:    *indexAlias,
 		Shards:   *indexShards,
 		Replicas: *indexReplicas,
-	})
-	if err != nil {
-		log.Fatal("Failed to create index template", zap.Error(err))
+		MaxAge:   *indexMaxAge,
+		MaxDocs:  *indexMaxDocs,
+		MaxSize:  *indexMaxSize,
+	}}
+	for _, rule := range routes {
+		// settings a rule leaves out default to those of the default alias
+		if rule.Shards == 0 {
+			rule.Shards = *indexShards
+		}
+		if rule.Replicas == 0 {
+			rule.Replicas = *indexReplicas
+		}
+		if rule.MaxAge == "" && rule.MaxDocs == 0 && rule.MaxSize == "" {
+			rule.MaxAge, rule.MaxDocs, rule.MaxSize = *indexMaxAge, *indexMaxDocs, *indexMaxSize
+		}
+		targets = append(targets, rule)
 	}
 
-	if !*indexDaily {
-		_, err = elasticsearch.NewIndexService(ctx, log, client, &elasticsearch.IndexConfig{
-			Alias:   *indexAlias,
-			MaxAge:  *indexMaxAge,
-			MaxDocs: *indexMaxDocs,
-			MaxSize: *indexMaxSize,
+	if err := elasticsearch.ValidateStorage(*storageMode); err != nil {
+		log.Fatal("Invalid storage mode", zap.Error(err))
+	}
+	dataStream := elasticsearch.IsDataStream(*storageMode)
+	if dataStream && (*indexDaily || *dsEnabled) {
+		log.Fatal("Daily indices and downsampling are not supported with data streams")
+	}
+
+	for i, target := range targets {
+		if dataStream {
+			retention := target.RetentionPeriod()
+			if i == 0 {
+				retention = *indexRetain
+			}
+			err = elasticsearch.EnsureDataStreamTemplate(ctx, client, &elasticsearch.DataStreamTemplateConfig{
+				Alias:     target.Alias,
+				Shards:    target.Shards,
+				Replicas:  target.Replicas,
+				Storage:   *storageMode,
+				Retention: retention,
+				LookBack:  *tsdsLookBack,
+				MaxAge:    target.MaxAge,
+				MaxDocs:   target.MaxDocs,
+				MaxSize:   target.MaxSize,
+			})
+			if err != nil {
+				log.Fatal("Failed to create data stream template", zap.Error(err))
+			}
+			continue
+		}
+
+		err = elasticsearch.EnsureIndexTemplate(ctx, client, &elasticsearch.IndexTemplateConfig{
+			Alias:    target.Alias,
+			Shards:   target.Shards,
+			Replicas: target.Replicas,
+			Profile:  *indexProfile,
 		})
 		if err != nil {
-			log.Fatal("Failed to create indexer", zap.Error(err))
+			log.Fatal("Failed to create index template", zap.Error(err))
+		}
+
+		if !*indexDaily {
+			_, err = elasticsearch.NewIndexService(ctx, log, client, &elasticsearch.IndexConfig{
+				Alias:   target.Alias,
+				MaxAge:  target.MaxAge,
+				MaxDocs: target.MaxDocs,
+				MaxSize: target.MaxSize,
+			})
+			if err != nil {
+				log.Fatal("Failed to create indexer", zap.Error(err))
+			}
+		}
+	}
+
+	var resolutions []time.Duration
+	if *dsEnabled {
+		resolutions, err = elasticsearch.ParseResolutions(*dsResolutions)
+		if err != nil {
+			log.Fatal("Invalid downsample resolutions", zap.Error(err))
+		}
+		_, err = elasticsearch.NewDownsampleService(ctx, log, client, &elasticsearch.DownsampleConfig{
+			Alias:       *indexAlias,
+			Resolutions: resolutions,
+			Shards:      *indexShards,
+			Replicas:    *indexReplicas,
+			Delay:       *dsDelay,
+			Lookback:    *dsLookback,
+			Interval:    *dsInterval,
+			BatchSize:   *searchMaxDocs,
+			RoutingKey:  *routingKey,
+			DocValues:   *indexProfile == elasticsearch.ProfileOptimized,
+		})
+		if err != nil {
+			log.Fatal("Failed to create downsampler", zap.Error(err))
+		}
+	}
+
+	// data streams expire samples themselves
+	if *indexRetain > 0 && !dataStream {
+		elasticsearch.NewRetentionService(ctx, log, client, &elasticsearch.RetentionConfig{
+			Alias:       *indexAlias,
+			Resolutions: resolutions,
+			Retention:   *indexRetain,
+		})
+	}
+	for _, rule := range routes {
+		if rule.RetentionPeriod() > 0 && !dataStream {
+			elasticsearch.NewRetentionService(ctx, log, client, &elasticsearch.RetentionConfig{
+				Alias:     rule.Alias,
+				Retention: rule.RetentionPeriod(),
+			})
 		}
 	}
 
 	readCfg := &elasticsearch.ReadConfig{
-		Alias:   *indexAlias,
-		MaxDocs: *searchMaxDocs,
+		Alias:          *indexAlias,
+		Daily:          *indexDaily,
+		MaxDocs:        *searchMaxDocs,
+		IndexRefresh:   *indexRefresh,
+		Concurrency:    *readWorkers,
+		SplitInterval:  *readSplit,
+		MaxSeries:      *readMaxSeries,
+		MaxSamples:     *readMaxSample,
+		MaxRange:       *readMaxRange,
+		Timeout:        *readTimeout,
+		TerminateAfter: *readTermAfter,
+		CacheMaxBytes:  *cacheMaxBytes,
+		CacheDir:       *cacheDir,
+		CacheStep:      *cacheStep,
+		CacheMinAge:    *cacheMinAge,
+		Resolutions:    resolutions,
+		Routes:         routes,
+		RoutingKey:     *routingKey,
+		DocValues:      *indexProfile == elasticsearch.ProfileOptimized,
+		Storage:        *storageMode,
+	}
+	readSvc, err := elasticsearch.NewReadService(log, client, readCfg)
+	if err != nil {
+		log.Fatal("Unable to create elasticsearch read service:", zap.Error(err))
 	}
-	readSvc := elasticsearch.NewReadService(log, client, readCfg)
 
 	writeCfg := &elasticsearch.WriteConfig{
-		Alias:   *indexAlias,
-		Daily:   *indexDaily,
-		MaxAge:  *batchMaxAge,
-		MaxDocs: *batchMaxDocs,
-		MaxSize: *batchMaxSize,
-		Workers: *workers,
-		Stats:   *statsEnabled,
+		Alias:              *indexAlias,
+		Daily:              *indexDaily,
+		MaxAge:             *batchMaxAge,
+		MaxDocs:            *batchMaxDocs,
+		MaxSize:            *batchMaxSize,
+		Workers:            *workers,
+		Stats:              *statsEnabled,
+		OpType:             *writeOpType,
+		HAClusterLabel:     *haCluster,
+		HAReplicaLabel:     *haReplica,
+		HAFailoverTimeout:  *haFailover,
+		MaxSampleAge:       *maxSampleAge,
+		MaxSampleFuture:    *maxSampleFut,
+		MaxSeriesPerTenant: *maxSeries,
+		SeriesIdleTimeout:  *seriesIdle,
+		SeriesStateFile:    *seriesState,
+		Routes:             routes,
+		RoutingKey:         *routingKey,
+		Storage:            *storageMode,
+		LookBack:           *tsdsLookBack,
 	}
+	if command == "backfill" {
+		backfillSvc, err := elasticsearch.NewWriteService(ctx, log, client, elasticsearch.BackfillConfig(writeCfg))
+		if err != nil {
+			log.Fatal("Unable to create elasticsearch adapter:", zap.Error(err))
+		}
+		defer backfillSvc.Close()
+		err = backfill.Run(ctx, log, backfillSvc, &backfill.Config{
+			Sources:          flag.Args(),
+			BatchSize:        *batchMaxDocs,
+			Rate:             *backfillRate,
+			Checkpoint:       *backfillCheck,
+			ProgressInterval: *backfillEvery,
+		})
+		if err != nil {
+			log.Fatal("Failed to backfill samples", zap.Error(err))
+		}
+		return
+	}
+
 	writeSvc, err := elasticsearch.NewWriteService(ctx, log, client, writeCfg)
 	if err != nil {
 		log.Fatal("Unable to create elasticsearch adapter:", zap.Error(err))
 	}
 	defer writeSvc.Close()
 
+	limits := &handlers.WriteLimitConfig{
+		TenantHeader:     *tenantHeader,
+		SamplesPerSecond: *samplesRate,
+		SamplesBurst:     *samplesBurst,
+		SeriesPerSecond:  *seriesRate,
+		SeriesBurst:      *seriesBurst,
+	}
+
 	// Create an "admin" listener on 0.0.0.0:9000
-	go http.ListenAndServe(":9000", handlers.NewAdminRouter(client))
+	go http.ListenAndServe(":9000", handlers.NewAdminRouter(client, readSvc))
 
 	graceful.ListenAndServe(&http.Server{
 		Addr: ":8000",
 		Handler: gorilla.RecoveryHandler(gorilla.PrintRecoveryStack(true))(
 			gorilla.CompressHandler(
-				handlers.NewRouter(writeSvc, readSvc),
+				handlers.NewRouter(log, writeSvc, readSvc, limits),
 			),
 		),
 	})
@@ -0,0 +1,373 @@
+package backfill
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"github.com/pwillie/prometheus-es-adapter/pkg/ratelimit"
+	"github.com/pwillie/prometheus-es-adapter/pkg/tsdb"
+	"go.uber.org/zap"
+)
+
+// tenant is the tenant backfilled samples are written as
+const tenant = "backfill"
+
+// Writer stores backfilled samples, as elasticsearch.WriteService does
+type Writer interface {
+	Write(tenant string, req []*prompb.TimeSeries) error
+	// Flush returns once the samples written so far are stored
+	Flush() error
+}
+
+// Config is used to configure Run
+type Config struct {
+	// Sources are TSDB block directories, directories holding blocks such as
+	// a Prometheus data directory, or OpenMetrics text files
+	Sources []string
+	// BatchSize is the number of samples written at once
+	BatchSize int
+	// Rate caps the samples written per second, zero is unlimited
+	Rate float64
+	// Checkpoint is the file progress is saved to and resumed from, empty
+	// disables resuming
+	Checkpoint string
+	// ProgressInterval is the period between progress reports
+	ProgressInterval time.Duration
+}
+
+// progress is how far a source has been written: the number of series of a
+// block or the byte offset into a file
+type progress struct {
+	Position int64 `json:"position"`
+	Done     bool  `json:"done"`
+}
+
+type backfill struct {
+	w       Writer
+	config  *Config
+	logger  *zap.Logger
+	limiter *ratelimit.Limiter
+
+	checkpoint map[string]*progress
+	batch      map[string]*prompb.TimeSeries
+	samples    int
+	written    int64
+	rejected   int64
+	reported   time.Time
+}
+
+// Run writes the samples of every source through w.  Progress is checkpointed
+// after every batch, so an interrupted backfill resumes where it stopped;
+// samples written again on resume are deduplicated by their document ids.
+func Run(ctx context.Context, logger *zap.Logger, w Writer, config *Config) error {
+	sources, err := expandSources(config.Sources)
+	if err != nil {
+		return err
+	}
+	b := &backfill{
+		w:          w,
+		config:     config,
+		logger:     logger,
+		checkpoint: make(map[string]*progress),
+		batch:      make(map[string]*prompb.TimeSeries),
+		reported:   time.Now(),
+	}
+	if config.Rate > 0 {
+		b.limiter = ratelimit.New(config.Rate, config.BatchSize)
+	}
+	if err := b.load(); err != nil {
+		return err
+	}
+	for _, source := range sources {
+		p, ok := b.checkpoint[source]
+		if !ok {
+			p = &progress{}
+			b.checkpoint[source] = p
+		}
+		if p.Done {
+			logger.Info("Skipping backfilled source", zap.String("source", source))
+			continue
+		}
+		logger.Info("Backfilling source", zap.String("source", source), zap.Int64("position", p.Position))
+		if tsdb.IsBlock(source) {
+			err = b.block(ctx, source, p)
+		} else {
+			err = b.file(ctx, source, p)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", source, err)
+		}
+		p.Done = true
+		if err := b.save(); err != nil {
+			return err
+		}
+	}
+	logger.Info("Backfill complete",
+		zap.Int64("samples", b.written),
+		zap.Int64("rejected", b.rejected))
+	return nil
+}
+
+// expandSources replaces directories which are not blocks themselves by the
+// blocks within them, in name and so time order
+func expandSources(paths []string) ([]string, error) {
+	var sources []string
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() || tsdb.IsBlock(path) {
+			sources = append(sources, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var blocks []string
+		for _, e := range entries {
+			if dir := filepath.Join(path, e.Name()); e.IsDir() && tsdb.IsBlock(dir) {
+				blocks = append(blocks, dir)
+			}
+		}
+		if len(blocks) == 0 {
+			return nil, fmt.Errorf("%s holds no TSDB blocks", path)
+		}
+		sort.Strings(blocks)
+		sources = append(sources, blocks...)
+	}
+	return sources, nil
+}
+
+// block backfills the series of a TSDB block from the position'th on
+func (b *backfill) block(ctx context.Context, dir string, p *progress) error {
+	blk, err := tsdb.OpenBlock(dir)
+	if err != nil {
+		return err
+	}
+	defer blk.Close()
+	tombstones, err := blk.Tombstones()
+	if err != nil {
+		return err
+	}
+	total := int64(blk.Meta.Stats.NumSeries)
+	err = blk.ForEachSeries(int(p.Position), func(i int, s *tsdb.Series) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := strconv.Itoa(i)
+		for _, ref := range s.Chunks {
+			samples, err := blk.Samples(ref)
+			if err != nil {
+				b.logger.Warn("Skipping chunk", zap.String("block", blk.Meta.ULID), zap.Uint64("ref", ref), zap.Error(err))
+				continue
+			}
+			if deleted := tombstones[s.Ref]; len(deleted) > 0 {
+				samples = undeleted(samples, deleted)
+			}
+			for len(samples) > 0 {
+				n := b.config.BatchSize - b.samples
+				if n > len(samples) {
+					n = len(samples)
+				}
+				b.add(key, s.Labels, samples[:n])
+				samples = samples[n:]
+				if b.samples >= b.config.BatchSize {
+					// the series is not complete, so is redone on resume
+					if err := b.flush(ctx, p, int64(i), total); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return b.flush(ctx, p, p.Position, total)
+}
+
+// undeleted returns the samples outside the deleted intervals
+func undeleted(samples []prompb.Sample, deleted []tsdb.Interval) []prompb.Sample {
+	kept := samples[:0]
+	for _, s := range samples {
+		if !tsdb.Deleted(s.Timestamp, deleted) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// file backfills an OpenMetrics text file from the position'th byte on
+func (b *backfill) file(ctx context.Context, path string, p *progress) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(p.Position, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	offset := p.Position
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if strings.TrimSpace(line) == openMetricsEOF {
+			break
+		}
+		ts, perr := parseOpenMetricsLine(line)
+		if perr != nil {
+			return fmt.Errorf("line at byte %d: %s", offset, perr)
+		}
+		offset += int64(len(line))
+		if ts != nil {
+			b.add(seriesKey(ts.Labels), ts.Labels, ts.Samples)
+			if b.samples >= b.config.BatchSize {
+				if err := b.flush(ctx, p, offset, info.Size()); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return b.flush(ctx, p, offset, info.Size())
+}
+
+// seriesKey identifies a series within a batch
+func seriesKey(labels []*prompb.Label) string {
+	var key strings.Builder
+	for _, l := range labels {
+		key.WriteString(l.Name)
+		key.WriteByte(0xff)
+		key.WriteString(l.Value)
+		key.WriteByte(0xff)
+	}
+	return key.String()
+}
+
+// add appends samples of a series to the batch
+func (b *backfill) add(key string, labels []*prompb.Label, samples []prompb.Sample) {
+	ts, ok := b.batch[key]
+	if !ok {
+		ts = &prompb.TimeSeries{Labels: labels}
+		b.batch[key] = ts
+	}
+	ts.Samples = append(ts.Samples, samples...)
+	b.samples += len(samples)
+}
+
+// flush writes the batch, waiting until it is stored, then checkpoints the
+// source at position out of total
+func (b *backfill) flush(ctx context.Context, p *progress, position, total int64) error {
+	if b.samples > 0 {
+		if b.limiter != nil {
+			if err := b.limiter.Acquire(ctx, tenant, b.samples); err != nil {
+				return err
+			}
+		}
+		series := make([]*prompb.TimeSeries, 0, len(b.batch))
+		for _, ts := range b.batch {
+			series = append(series, ts)
+		}
+		err := b.w.Write(tenant, series)
+		if rejected, ok := err.(*elasticsearch.RejectedError); ok {
+			// eg before the start of a time series data stream or
+			// beyond the write_max_sample_future
+			for _, n := range rejected.Rejected {
+				b.rejected += int64(n)
+			}
+			b.logger.Warn("Samples rejected", zap.Error(err))
+		} else if err != nil {
+			return err
+		}
+		if err := b.w.Flush(); err != nil {
+			return err
+		}
+		b.written += int64(b.samples)
+		b.batch = make(map[string]*prompb.TimeSeries)
+		b.samples = 0
+	}
+	p.Position = position
+	if err := b.save(); err != nil {
+		return err
+	}
+	if time.Since(b.reported) >= b.config.ProgressInterval {
+		var percent float64
+		if total > 0 {
+			percent = float64(position) / float64(total) * 100
+		}
+		b.logger.Info("Backfill progress",
+			zap.Int64("samples", b.written),
+			zap.Int64("rejected", b.rejected),
+			zap.String("source_progress", fmt.Sprintf("%.1f%%", percent)))
+		b.reported = time.Now()
+	}
+	return nil
+}
+
+func (b *backfill) load() error {
+	if b.config.Checkpoint == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.config.Checkpoint)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read backfill checkpoint: %s", err)
+	}
+	if err := json.Unmarshal(data, &b.checkpoint); err != nil {
+		return fmt.Errorf("Failed to decode backfill checkpoint: %s", err)
+	}
+	b.logger.Info("Resuming backfill", zap.String("checkpoint", b.config.Checkpoint))
+	return nil
+}
+
+func (b *backfill) save() error {
+	if b.config.Checkpoint == "" {
+		return nil
+	}
+	data, err := json.Marshal(b.checkpoint)
+	if err != nil {
+		return fmt.Errorf("Failed to encode backfill checkpoint: %s", err)
+	}
+	// write then rename so a crash never leaves a truncated checkpoint behind
+	tmp := b.config.Checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write backfill checkpoint: %s", err)
+	}
+	if err := os.Rename(tmp, b.config.Checkpoint); err != nil {
+		return fmt.Errorf("Failed to write backfill checkpoint: %s", err)
+	}
+	return nil
+}
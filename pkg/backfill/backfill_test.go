@@ -0,0 +1,28 @@
+package backfill
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/tsdb"
+)
+
+func TestUndeleted(t *testing.T) {
+	var samples []prompb.Sample
+	for ts := int64(0); ts < 10; ts++ {
+		samples = append(samples, prompb.Sample{Timestamp: ts * 1000, Value: float64(ts)})
+	}
+	got := undeleted(samples, []tsdb.Interval{{Mint: 1000, Maxt: 3000}, {Mint: 8500, Maxt: 20000}})
+	want := []prompb.Sample{
+		{Timestamp: 0, Value: 0},
+		{Timestamp: 4000, Value: 4},
+		{Timestamp: 5000, Value: 5},
+		{Timestamp: 6000, Value: 6},
+		{Timestamp: 7000, Value: 7},
+		{Timestamp: 8000, Value: 8},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package backfill
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// openMetricsEOF ends an OpenMetrics exposition
+const openMetricsEOF = "# EOF"
+
+// parseOpenMetricsLine parses a sample line of the OpenMetrics text format,
+// returning nil for comments and blank lines.  Every sample must carry a
+// timestamp, which OpenMetrics gives in seconds.  Exemplars are ignored.
+func parseOpenMetricsLine(line string) (*prompb.TimeSeries, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return nil, fmt.Errorf("missing value")
+	}
+	name := line[:end]
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return nil, fmt.Errorf("invalid metric name %q", name)
+	}
+	ts := &prompb.TimeSeries{
+		Labels: []*prompb.Label{{Name: model.MetricNameLabel, Value: name}},
+	}
+	rest := line[end:]
+	if strings.HasPrefix(rest, "{") {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return nil, err
+		}
+		ts.Labels = append(ts.Labels, labels...)
+		rest = rest[n:]
+	}
+	if i := strings.Index(rest, " # "); i >= 0 {
+		rest = rest[:i]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("expected a value and a timestamp")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", fields[0])
+	}
+	seconds, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", fields[1])
+	}
+	ts.Samples = []prompb.Sample{{
+		Value:     value,
+		Timestamp: int64(math.Round(seconds * 1000)),
+	}}
+	return ts, nil
+}
+
+// parseLabels parses a braced label set, returning the labels and the length
+// of the label set
+func parseLabels(s string) ([]*prompb.Label, int, error) {
+	var labels []*prompb.Label
+	i := 1
+	for {
+		if i < len(s) && s[i] == '}' {
+			return labels, i + 1, nil
+		}
+		eq := strings.IndexByte(s[i:], '=')
+		if eq <= 0 || i+eq+1 >= len(s) || s[i+eq+1] != '"' {
+			return nil, 0, fmt.Errorf("invalid label set")
+		}
+		name := s[i : i+eq]
+		if !model.LabelName(name).IsValid() {
+			return nil, 0, fmt.Errorf("invalid label name %q", name)
+		}
+		i += eq + 2
+
+		var value strings.Builder
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				value.WriteByte(s[i])
+				continue
+			}
+			if i++; i >= len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case '\\', '"':
+				value.WriteByte(s[i])
+			default:
+				return nil, 0, fmt.Errorf("invalid escape in label %s", name)
+			}
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("unterminated value of label %s", name)
+		}
+		labels = append(labels, &prompb.Label{Name: name, Value: value.String()})
+		i++
+		if i < len(s) && s[i] == ',' {
+			i++
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package backfill
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+)
+
+func TestParseOpenMetricsLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		labels []*prompb.Label
+		sample prompb.Sample
+	}{
+		{
+			"up 1 1600000000\n",
+			[]*prompb.Label{{Name: "__name__", Value: "up"}},
+			prompb.Sample{Timestamp: 1600000000000, Value: 1},
+		},
+		{
+			`node:load1{instance="host:9100",job="node"} 0.25 1600000000.123` + "\r\n",
+			[]*prompb.Label{
+				{Name: "__name__", Value: "node:load1"},
+				{Name: "instance", Value: "host:9100"},
+				{Name: "job", Value: "node"},
+			},
+			prompb.Sample{Timestamp: 1600000000123, Value: 0.25},
+		},
+		{
+			`escaped{path="C:\\tmp",msg="say \"hi\"\nbye",empty=""} 2 1.5`,
+			[]*prompb.Label{
+				{Name: "__name__", Value: "escaped"},
+				{Name: "path", Value: `C:\tmp`},
+				{Name: "msg", Value: "say \"hi\"\nbye"},
+				{Name: "empty", Value: ""},
+			},
+			prompb.Sample{Timestamp: 1500, Value: 2},
+		},
+		{
+			`braces{a="}{,=",} 3 1e3`,
+			[]*prompb.Label{
+				{Name: "__name__", Value: "braces"},
+				{Name: "a", Value: "}{,="},
+			},
+			prompb.Sample{Timestamp: 1000000, Value: 3},
+		},
+		{
+			`requests_total{code="200"} 1027 1600000000 # {trace_id="abc"} 1 1599999999`,
+			[]*prompb.Label{
+				{Name: "__name__", Value: "requests_total"},
+				{Name: "code", Value: "200"},
+			},
+			prompb.Sample{Timestamp: 1600000000000, Value: 1027},
+		},
+		{
+			"neg -1.5e-3 -1",
+			[]*prompb.Label{{Name: "__name__", Value: "neg"}},
+			prompb.Sample{Timestamp: -1000, Value: -1.5e-3},
+		},
+		{
+			// timestamps are rounded to the millisecond
+			"rounded 1 0.0005",
+			[]*prompb.Label{{Name: "__name__", Value: "rounded"}},
+			prompb.Sample{Timestamp: 1, Value: 1},
+		},
+		{
+			"inf +Inf 1",
+			[]*prompb.Label{{Name: "__name__", Value: "inf"}},
+			prompb.Sample{Timestamp: 1000, Value: math.Inf(1)},
+		},
+		{
+			"nan NaN 1",
+			[]*prompb.Label{{Name: "__name__", Value: "nan"}},
+			prompb.Sample{Timestamp: 1000, Value: math.NaN()},
+		},
+	}
+	for _, test := range tests {
+		ts, err := parseOpenMetricsLine(test.line)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(ts.Labels, test.labels) {
+			t.Errorf("%q: got labels %v, want %v", test.line, ts.Labels, test.labels)
+		}
+		if len(ts.Samples) != 1 {
+			t.Errorf("%q: got %d samples, want 1", test.line, len(ts.Samples))
+			continue
+		}
+		s := ts.Samples[0]
+		if s.Timestamp != test.sample.Timestamp || math.Float64bits(s.Value) != math.Float64bits(test.sample.Value) {
+			t.Errorf("%q: got %v@%d, want %v@%d", test.line, s.Value, s.Timestamp, test.sample.Value, test.sample.Timestamp)
+		}
+	}
+}
+
+func TestParseOpenMetricsLineIgnored(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"\n",
+		"# TYPE up gauge\n",
+		"# HELP up Whether the target is up.\n",
+		"# UNIT request_seconds seconds\n",
+		openMetricsEOF,
+	} {
+		ts, err := parseOpenMetricsLine(line)
+		if ts != nil || err != nil {
+			t.Errorf("%q: got %v, %v, want nothing", line, ts, err)
+		}
+	}
+}
+
+func TestParseOpenMetricsLineInvalid(t *testing.T) {
+	for _, line := range []string{
+		"up",
+		"up 1",
+		"up 1 2 3",
+		"{job=\"a\"} 1 2",
+		"1up 1 2",
+		"up one 2",
+		"up 1 two",
+		`up{job} 1 2`,
+		`up{job=a} 1 2`,
+		`up{1job="a"} 1 2`,
+		`up{job="a} 1 2`,
+		`up{job="a\`,
+		`up{job="\t"} 1 2`,
+		`up{job="a"`,
+	} {
+		if _, err := parseOpenMetricsLine(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+// recordWriter keeps the series written to it
+type recordWriter struct {
+	series []*prompb.TimeSeries
+}
+
+func (w *recordWriter) Write(tenant string, req []*prompb.TimeSeries) error {
+	w.series = append(w.series, req...)
+	return nil
+}
+
+func (w *recordWriter) Flush() error {
+	return nil
+}
+
+func TestBackfillFileStopsAtEOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.txt")
+	data := "# TYPE up gauge\n" +
+		"up{job=\"a\"} 1 1\n" +
+		"up{job=\"a\"} 0 2\n" +
+		"# EOF\n" +
+		"up{job=\"a\"} 1 3\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &recordWriter{}
+	err = Run(context.Background(), zap.NewNop(), w, &Config{
+		Sources:   []string{path},
+		BatchSize: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.series) != 1 {
+		t.Fatalf("got %d series, want 1", len(w.series))
+	}
+	want := []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0}}
+	if !reflect.DeepEqual(w.series[0].Samples, want) {
+		t.Errorf("got samples %v, want %v", w.series[0].Samples, want)
+	}
+}
@@ -0,0 +1,184 @@
+package elasticsearch
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+)
+
+// readCache is an LRU cache of query results for immutable, step aligned time
+// ranges.  Entries are bounded by an estimate of their size in bytes and are
+// optionally persisted to disk so they survive restarts.
+type readCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	dir      string
+	lru      *list.List
+	entries  map[string]*list.Element
+	logger   *zap.Logger
+}
+
+type cacheEntry struct {
+	key    string
+	series []*prompb.TimeSeries
+	size   int64
+}
+
+func newReadCache(logger *zap.Logger, maxBytes int64, dir string) (*readCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create cache directory: %s", err)
+		}
+	}
+	return &readCache{
+		maxBytes: maxBytes,
+		dir:      dir,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		logger:   logger,
+	}, nil
+}
+
+func (c *readCache) get(key string) ([]*prompb.TimeSeries, bool) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		cacheRequestsTotal.WithLabelValues("hit").Inc()
+		return e.Value.(*cacheEntry).series, true
+	}
+	c.mu.Unlock()
+
+	if series, ok := c.load(key); ok {
+		c.add(key, series)
+		cacheRequestsTotal.WithLabelValues("disk_hit").Inc()
+		return series, true
+	}
+	cacheRequestsTotal.WithLabelValues("miss").Inc()
+	return nil, false
+}
+
+func (c *readCache) put(key string, series []*prompb.TimeSeries) {
+	c.add(key, series)
+	c.store(key, series)
+}
+
+func (c *readCache) add(key string, series []*prompb.TimeSeries) {
+	entry := &cacheEntry{key: key, series: series, size: seriesSize(series)}
+	if entry.size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.bytes -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += entry.size
+	for c.bytes > c.maxBytes {
+		oldest := c.lru.Back()
+		evicted := c.lru.Remove(oldest).(*cacheEntry)
+		delete(c.entries, evicted.key)
+		c.bytes -= evicted.size
+	}
+	cacheBytes.Set(float64(c.bytes))
+}
+
+func (c *readCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *readCache) load(key string) ([]*prompb.TimeSeries, bool) {
+	if c.dir == "" {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var result prompb.QueryResult
+	if err := proto.Unmarshal(data, &result); err != nil {
+		c.logger.Warn("Failed to decode cached result", zap.Error(err))
+		return nil, false
+	}
+	return result.Timeseries, true
+}
+
+func (c *readCache) store(key string, series []*prompb.TimeSeries) {
+	if c.dir == "" {
+		return
+	}
+	data, err := proto.Marshal(&prompb.QueryResult{Timeseries: series})
+	if err != nil {
+		c.logger.Warn("Failed to encode cached result", zap.Error(err))
+		return
+	}
+	// write then rename so a crash never leaves a truncated entry behind
+	tmp := c.path(key) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		c.logger.Warn("Failed to write cached result", zap.Error(err))
+		return
+	}
+	if err := os.Rename(tmp, c.path(key)); err != nil {
+		c.logger.Warn("Failed to write cached result", zap.Error(err))
+	}
+}
+
+// seriesSize estimates the memory held by a set of series
+func seriesSize(series []*prompb.TimeSeries) int64 {
+	size := int64(len(series)) * 64
+	for _, ts := range series {
+		size += int64(len(ts.Samples)) * 16
+		for _, l := range ts.Labels {
+			size += int64(len(l.Name)+len(l.Value)) + 32
+		}
+	}
+	return size
+}
+
+// cacheKey identifies the results of a set of matchers over a time range.
+// Matchers are sorted so equivalent queries share entries.  Rollup results
+// also depend on the resolution and the aggregate selected by fn.
+func cacheKey(matchers []*prompb.LabelMatcher, r timeRange, fn string) string {
+	parts := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		parts = append(parts, fmt.Sprintf("%q|%d|%q", m.Name, m.Type, m.Value))
+	}
+	sort.Strings(parts)
+	key := fmt.Sprintf("%s|%d|%d", strings.Join(parts, ","), r.start, r.end-r.start+1)
+	if r.resolution > 0 {
+		field, _ := rollupField(fn)
+		key += fmt.Sprintf("|%s|%s", r.resolution, field)
+	}
+	return key
+}
+
+// cachedRange returns the series for an immutable block, searching and caching
+// them on a miss.  Results are only cached when complete.
+func (svc *ReadService) cachedRange(ctx context.Context, matchers []*prompb.LabelMatcher, r timeRange, fn string) ([]*prompb.TimeSeries, error) {
+	key := cacheKey(matchers, r, fn)
+	if series, ok := svc.cache.get(key); ok {
+		return series, nil
+	}
+	series, complete, err := svc.search(ctx, matchers, r, fn)
+	if err == nil && complete {
+		svc.cache.put(key, series)
+	}
+	return series, err
+}
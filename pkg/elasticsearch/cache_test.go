@@ -0,0 +1,48 @@
+package elasticsearch
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestCacheKey(t *testing.T) {
+	r := timeRange{start: 0, end: 7199999}
+	matcher := func(name string, typ prompb.LabelMatcher_Type, value string) []*prompb.LabelMatcher {
+		return []*prompb.LabelMatcher{{Name: name, Type: typ, Value: value}}
+	}
+	distinct := [][]*prompb.LabelMatcher{
+		matcher("aN", prompb.LabelMatcher_EQ, "x"),
+		matcher("a", prompb.LabelMatcher_NEQ, "x"),
+		matcher("a", prompb.LabelMatcher_EQ, "x"),
+		matcher("a", prompb.LabelMatcher_RE, "x"),
+		matcher("a", prompb.LabelMatcher_NRE, "x"),
+		matcher("a|0", prompb.LabelMatcher_EQ, "x"),
+		matcher("a", prompb.LabelMatcher_EQ, `x","b|0|"y`),
+		{
+			{Name: "a", Type: prompb.LabelMatcher_EQ, Value: "x"},
+			{Name: "b", Type: prompb.LabelMatcher_EQ, Value: "y"},
+		},
+	}
+	seen := make(map[string]int)
+	for i, matchers := range distinct {
+		key := cacheKey(matchers, r, "")
+		if j, ok := seen[key]; ok {
+			t.Errorf("matchers %d and %d share the key %s", j, i, key)
+		}
+		seen[key] = i
+	}
+
+	// matcher order does not matter
+	a := []*prompb.LabelMatcher{
+		{Name: "a", Type: prompb.LabelMatcher_EQ, Value: "x"},
+		{Name: "b", Type: prompb.LabelMatcher_RE, Value: "y"},
+	}
+	b := []*prompb.LabelMatcher{a[1], a[0]}
+	if cacheKey(a, r, "") != cacheKey(b, r, "") {
+		t.Errorf("reordered matchers have different keys")
+	}
+	if cacheKey(a, r, "") == cacheKey(a, timeRange{start: 0, end: 3599999}, "") {
+		t.Errorf("different ranges share a key")
+	}
+}
@@ -20,12 +20,185 @@ const indexTemplate = `{
 				"enabled": true
 			},
 			"properties": {
+				"fingerprint": {
+					"type": "keyword"
+				},
+				"timestamp": {
+					"type": "date",
+					"format": "strict_date_optional_time||epoch_millis"
+				},
+				"value": {
+					"type": "double"
+				},
+				"stale": {
+					"type": "boolean"
+				},
+				"special": {
+					"type": "keyword"
+				}
+			},
+			"dynamic_templates": [
+				{
+					"strings": {
+						"match_mapping_type": "string",
+						"path_match": "label.*",
+						"mapping": {
+							"type": "keyword"
+						}
+					}
+				}
+			]
+		}
+	}
+}`
+
+// optimizedIndexTemplate trades the ability to reindex or inspect documents for
+// smaller, faster indices.  Documents are sorted by series and time, _source is
+// not stored and samples are read back from doc values, and fields which are
+// never searched are not indexed.
+const optimizedIndexTemplate = `{
+	"index_patterns": ["{{.Alias}}-*"],
+	"settings": {
+		"number_of_shards": {{.Shards}},
+		"number_of_replicas": {{.Replicas}},
+		"index.codec": "best_compression",
+		"index.sort.field": ["fingerprint", "timestamp"],
+		"index.sort.order": ["asc", "asc"]
+	},
+	"mappings": {
+		"sample": {
+			"_source": {
+				"enabled": false
+			},
+			"properties": {
+				"fingerprint": {
+					"type": "keyword"
+				},
+				"timestamp": {
+					"type": "date",
+					"format": "strict_date_optional_time||epoch_millis"
+				},
+				"value": {
+					"type": "double",
+					"index": false
+				},
+				"stale": {
+					"type": "boolean",
+					"index": false
+				},
+				"special": {
+					"type": "keyword",
+					"index": false
+				}
+			},
+			"dynamic_templates": [
+				{
+					"strings": {
+						"match_mapping_type": "string",
+						"path_match": "label.*",
+						"mapping": {
+							"type": "keyword",
+							"norms": false
+						}
+					}
+				}
+			]
+		}
+	}
+}`
+
+// tsdsTemplate declares a time series data stream.  Labels are its dimensions
+// and samples keep their timestamp field besides the @timestamp data streams
+// require, so searches work alike in every storage mode.  The look back time
+// bounds how old samples written once the data stream is created may be.
+const tsdsTemplate = `{
+	"index_patterns": ["{{.Alias}}"],
+	"data_stream": {},
+	"priority": 200,
+	"template": {
+		"settings": {
+			"number_of_shards": {{.Shards}},
+			"number_of_replicas": {{.Replicas}},
+			"index.mode": "time_series",
+			"index.routing_path": ["label.*"]{{if .LookBackTime}},
+			"index.look_back_time": "{{.LookBackTime}}"{{end}}
+		},
+		"mappings": {
+			"properties": {
+				"@timestamp": {
+					"type": "date",
+					"format": "strict_date_optional_time||epoch_millis"
+				},
+				"timestamp": {
+					"type": "date",
+					"format": "strict_date_optional_time||epoch_millis"
+				},
+				"fingerprint": {
+					"type": "keyword"
+				},
+				"value": {
+					"type": "double",
+					"time_series_metric": "gauge"
+				},
+				"stale": {
+					"type": "boolean"
+				},
+				"special": {
+					"type": "keyword"
+				}
+			},
+			"dynamic_templates": [
+				{
+					"labels": {
+						"match_mapping_type": "string",
+						"path_match": "label.*",
+						"mapping": {
+							"type": "keyword",
+							"time_series_dimension": true
+						}
+					}
+				}
+			]
+		}{{if .DataRetention}},
+		"lifecycle": {
+			"data_retention": "{{.DataRetention}}"
+		}{{end}}
+	}
+}`
+
+// dataStreamTemplate declares a data stream rolled over by the ILM policy named
+// after it
+const dataStreamTemplate = `{
+	"index_patterns": ["{{.Alias}}"],
+	"data_stream": {},
+	"priority": 200,
+	"template": {
+		"settings": {
+			"number_of_shards": {{.Shards}},
+			"number_of_replicas": {{.Replicas}},
+			"index.lifecycle.name": "{{.Alias}}"
+		},
+		"mappings": {
+			"properties": {
+				"@timestamp": {
+					"type": "date",
+					"format": "strict_date_optional_time||epoch_millis"
+				},
 				"timestamp": {
 					"type": "date",
 					"format": "strict_date_optional_time||epoch_millis"
 				},
+				"fingerprint": {
+					"type": "keyword"
+				},
 				"value": {
 					"type": "double"
+				},
+				"stale": {
+					"type": "boolean"
+				},
+				"special": {
+					"type": "keyword"
 				}
 			},
 			"dynamic_templates": [
@@ -42,3 +215,63 @@ const indexTemplate = `{
 		}
 	}
 }`
+
+// rollupTemplate takes precedence over indexTemplate, whose pattern also
+// matches the rollup indices
+const rollupTemplate = `{
+	"index_patterns": [{{range $i, $p := .Patterns}}{{if $i}}, {{end}}"{{$p}}"{{end}}],
+	"order": 1,
+	"settings": {
+		"number_of_shards": {{.Shards}},
+		"number_of_replicas": {{.Replicas}}
+	},
+	"mappings": {
+		"sample": {
+			"_source": {
+				"enabled": true
+			},
+			"properties": {
+				"fingerprint": {
+					"type": "keyword"
+				},
+				"timestamp": {
+					"type": "date",
+					"format": "strict_date_optional_time||epoch_millis"
+				},
+				"first_timestamp": {
+					"type": "date",
+					"format": "strict_date_optional_time||epoch_millis"
+				},
+				"last_timestamp": {
+					"type": "date",
+					"format": "strict_date_optional_time||epoch_millis"
+				},
+				"min": {
+					"type": "double"
+				},
+				"max": {
+					"type": "double"
+				},
+				"sum": {
+					"type": "double"
+				},
+				"count": {
+					"type": "long"
+				},
+				"first": {
+					"type": "double"
+				},
+				"last": {
+					"type": "double"
+				},
+				"counter": {
+					"type": "boolean"
+				},
+				"resets": {
+					"type": "object",
+					"enabled": false
+				}
+			}
+		}
+	}
+}`
@@ -0,0 +1,183 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// Storage modes
+const (
+	// StorageIndex writes samples into daily or rollover indices behind an alias
+	StorageIndex = "index"
+	// StorageTSDS writes samples into an Elasticsearch time series data stream
+	StorageTSDS = "tsds"
+	// StorageDataStream writes samples into a data stream rolled over by ILM
+	StorageDataStream = "datastream"
+)
+
+// ValidateStorage checks a storage mode is known
+func ValidateStorage(storage string) error {
+	switch storage {
+	case StorageIndex, StorageTSDS, StorageDataStream:
+		return nil
+	}
+	return fmt.Errorf("unknown storage mode %q", storage)
+}
+
+// IsDataStream reports whether samples are stored in a data stream named after
+// the alias rather than in indices behind it
+func IsDataStream(storage string) bool {
+	return storage == StorageTSDS || storage == StorageDataStream
+}
+
+// defaultLookBack is the Elasticsearch default of how far before its creation
+// a time series data stream accepts samples
+const defaultLookBack = 2 * time.Hour
+
+// DataStreamTemplateConfig is used to resolve the data stream index template
+type DataStreamTemplateConfig struct {
+	Alias    string
+	Shards   int
+	Replicas int
+	Storage  string
+	// Retention is how long samples are kept, zero forever
+	Retention time.Duration
+	// LookBack is how far before the creation of a time series data stream
+	// samples are accepted, zero the Elasticsearch default of two hours
+	LookBack time.Duration
+	// MaxAge, MaxDocs and MaxSize are the rollover conditions of the ILM
+	// policy of StorageDataStream
+	MaxAge  string
+	MaxDocs int64
+	MaxSize string
+}
+
+// EnsureDataStreamTemplate creates or updates the composable index template
+// declaring the data stream named after the alias.  Data streams need
+// Elasticsearch 7.9 or later, time series data streams 8.7 or later.
+func EnsureDataStreamTemplate(ctx context.Context, client *elastic.Client, config *DataStreamTemplateConfig) error {
+	var text string
+	switch config.Storage {
+	case StorageTSDS:
+		text = tsdsTemplate
+	case StorageDataStream:
+		text = dataStreamTemplate
+		if err := ensureLifecyclePolicy(ctx, client, config); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("storage mode %q does not use a data stream", config.Storage)
+	}
+	var retention string
+	if config.Retention > 0 {
+		retention = fmt.Sprintf("%ds", int64(config.Retention/time.Second))
+	}
+	var lookBack string
+	if config.LookBack > 0 {
+		lookBack = fmt.Sprintf("%ds", int64(config.LookBack/time.Second))
+	}
+	var buf bytes.Buffer
+	t := template.Must(template.New("datastream").Parse(text))
+	err := t.Execute(&buf, struct {
+		*DataStreamTemplateConfig
+		DataRetention string
+		LookBackTime  string
+	}{config, retention, lookBack})
+	if err != nil {
+		return fmt.Errorf("executing template: %s", err)
+	}
+
+	_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/_index_template/" + config.Alias,
+		Body:   buf.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create data stream template: %s", err)
+	}
+	return nil
+}
+
+// ensureLifecyclePolicy creates or updates the ILM policy named after the
+// alias, rolling the data stream over on the configured conditions and
+// deleting backing indices after the retention period
+func ensureLifecyclePolicy(ctx context.Context, client *elastic.Client, config *DataStreamTemplateConfig) error {
+	rollover := make(map[string]interface{})
+	if config.MaxAge != "" {
+		rollover["max_age"] = config.MaxAge
+	}
+	if config.MaxDocs > 0 {
+		rollover["max_docs"] = config.MaxDocs
+	}
+	if config.MaxSize != "" {
+		rollover["max_size"] = config.MaxSize
+	}
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{
+			"actions": map[string]interface{}{
+				"rollover": rollover,
+			},
+		},
+	}
+	if config.Retention > 0 {
+		phases["delete"] = map[string]interface{}{
+			"min_age": fmt.Sprintf("%ds", int64(config.Retention/time.Second)),
+			"actions": map[string]interface{}{
+				"delete": map[string]interface{}{},
+			},
+		}
+	}
+	_, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/_ilm/policy/" + config.Alias,
+		Body: map[string]interface{}{
+			"policy": map[string]interface{}{
+				"phases": phases,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create lifecycle policy: %s", err)
+	}
+	return nil
+}
+
+// MigrateToDataStream converts the rollover indices behind an alias into the
+// backing indices of a data stream of the same name.  Existing documents keep
+// their timestamp field, which reads use, so only the @timestamp mapping data
+// streams require is added to them.  The rollup indices of resolutions are
+// left as they are.  Converting needs Elasticsearch 7.11 or later.
+func MigrateToDataStream(ctx context.Context, client *elastic.Client, config *DataStreamTemplateConfig, resolutions []time.Duration) error {
+	if err := EnsureDataStreamTemplate(ctx, client, config); err != nil {
+		return err
+	}
+	_, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/" + strings.Join(rawIndexPatterns(config.Alias, resolutions), ",") + "/_mapping",
+		Body: map[string]interface{}{
+			"properties": map[string]interface{}{
+				"@timestamp": map[string]interface{}{
+					"type":   "date",
+					"format": "strict_date_optional_time||epoch_millis",
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to map @timestamp: %s", err)
+	}
+	_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/_data_stream/_migrate/" + config.Alias,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to migrate alias to data stream: %s", err)
+	}
+	return nil
+}
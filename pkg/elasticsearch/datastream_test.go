@@ -0,0 +1,143 @@
+package elasticsearch
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// searchResponse7 is a search response of Elasticsearch 7.17 against a data
+// stream, opening a scroll
+const searchResponse7 = `{
+  "_scroll_id": "FGluY2x1ZGVfY29udGV4dF91dWlkDXF1ZXJ5QW5kRmV0Y2gBFjVqUXFsdFVwUm1TRHpVTWRfaEF3RmcAAAAAAAAAChZsS3F4ZFFqZFN1S2hUaDZVRWV1bnpB",
+  "took": 5,
+  "timed_out": false,
+  "_shards": {"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+  "hits": {
+    "total": {"value": 2, "relation": "eq"},
+    "max_score": null,
+    "hits": [
+      {
+        "_index": ".ds-prometheus-2023.11.20-000001",
+        "_type": "_doc",
+        "_id": "a7c2d4e1b0f39c58-1700489100000",
+        "_score": null,
+        "_source": {
+          "label": {"__name__": "up", "job": "node"},
+          "fingerprint": "a7c2d4e1b0f39c58",
+          "value": 1,
+          "timestamp": 1700489100000,
+          "@timestamp": 1700489100000
+        },
+        "sort": [1700489100000]
+      },
+      {
+        "_index": ".ds-prometheus-2023.11.20-000001",
+        "_type": "_doc",
+        "_id": "a7c2d4e1b0f39c58-1700489160000",
+        "_score": null,
+        "_source": {
+          "label": {"__name__": "up", "job": "node"},
+          "fingerprint": "a7c2d4e1b0f39c58",
+          "value": 0,
+          "timestamp": 1700489160000,
+          "@timestamp": 1700489160000
+        },
+        "sort": [1700489160000]
+      }
+    ]
+  }
+}`
+
+// newTestClient returns a client of an Elasticsearch 7 stub answering every
+// search with searchResponse7, which also receives the requested paths.  The
+// stub must be closed.
+func newTestClient(t *testing.T, paths chan<- string) (*elastic.Client, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case paths <- r.URL.Path:
+		default:
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_search/scroll":
+			io.WriteString(w, `{"_scroll_id": "x", "took": 1, "hits": {"total": {"value": 2, "relation": "eq"}, "hits": []}}`)
+		case "/prometheus/_search":
+			io.WriteString(w, searchResponse7)
+		default:
+			io.WriteString(w, `{}`)
+		}
+	}))
+	client, err := elastic.NewClient(
+		elastic.SetURL(server.URL),
+		elastic.SetSniff(false),
+		elastic.SetHealthcheck(false),
+		elastic.SetDecoder(&Decoder{}),
+	)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestDataStreamRead(t *testing.T) {
+	paths := make(chan string, 10)
+	client, server := newTestClient(t, paths)
+	defer server.Close()
+	svc, err := NewReadService(zap.NewNop(), client, &ReadConfig{
+		Alias:       "prometheus",
+		MaxDocs:     100,
+		Concurrency: 1,
+		Storage:     StorageDataStream,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := svc.Read(context.Background(), []*prompb.Query{{
+		StartTimestampMs: 1700489000000,
+		EndTimestampMs:   1700489200000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if path := <-paths; path != "/prometheus/_search" {
+		t.Errorf("searched %s, want the data stream without a type", path)
+	}
+	if len(results) != 1 || len(results[0].Timeseries) != 1 || len(results[0].Timeseries[0].Samples) != 2 {
+		t.Fatalf("got %v", results)
+	}
+	if s := results[0].Timeseries[0].Samples; s[0].Value != 1 || s[1].Timestamp != 1700489160000 {
+		t.Errorf("got samples %v", s)
+	}
+}
+
+func TestDataStreamScroll(t *testing.T) {
+	// migrations, exports and downsampling scroll with the elastic client
+	client, server := newTestClient(t, nil)
+	defer server.Close()
+	scroll := client.Scroll("prometheus").Size(100)
+	resp, err := scroll.Do(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.TotalHits() != 2 || len(resp.Hits.Hits) != 2 {
+		t.Fatalf("got %d total, %d hits", resp.TotalHits(), len(resp.Hits.Hits))
+	}
+	for _, hit := range resp.Hits.Hits {
+		if _, err := decodeSample(hit, false); err != nil {
+			t.Errorf("%s: %s", hit.Id, err)
+		}
+	}
+	if _, err := scroll.Do(context.Background()); err != io.EOF {
+		t.Errorf("got %v at the end of the scroll, want io.EOF", err)
+	}
+}
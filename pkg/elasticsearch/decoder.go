@@ -0,0 +1,84 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// Decoder decodes Elasticsearch responses as elastic.DefaultDecoder does,
+// except that search results also accept the {"value": n, "relation": "eq"}
+// object which Elasticsearch 7 and later return as hits.total instead of a
+// number.  Clients talking to those versions must be created with
+// elastic.SetDecoder(&Decoder{}).
+type Decoder struct{}
+
+// Decode decodes data into v
+func (d *Decoder) Decode(data []byte, v interface{}) error {
+	if r, ok := v.(*elastic.SearchResult); ok {
+		resp, err := decodeSearchResult(data)
+		if err != nil {
+			return err
+		}
+		*r = resp.SearchResult
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// searchResult adds the terminated_early flag, which elastic.SearchResult
+// does not decode, to a search response
+type searchResult struct {
+	elastic.SearchResult
+	TerminatedEarly bool
+}
+
+// decodeSearchResult decodes a search response of any Elasticsearch version
+func decodeSearchResult(data []byte) (*searchResult, error) {
+	resp := new(searchResult)
+	var body struct {
+		*elastic.SearchResult
+		// shadows SearchResult.Hits
+		Hits *struct {
+			*elastic.SearchHits
+			// shadows SearchHits.TotalHits
+			Total hitsTotal `json:"total"`
+		} `json:"hits"`
+		TerminatedEarly bool `json:"terminated_early"`
+	}
+	body.SearchResult = &resp.SearchResult
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	if body.Hits != nil {
+		hits := body.Hits.SearchHits
+		if hits == nil {
+			hits = new(elastic.SearchHits)
+		}
+		hits.TotalHits = int64(body.Hits.Total)
+		resp.Hits = hits
+	}
+	resp.TerminatedEarly = body.TerminatedEarly
+	return resp, nil
+}
+
+// hitsTotal is the hits.total of a search response, a number before
+// Elasticsearch 7 and an object holding the number since.  Searches must track
+// total hits for the number to be exact past 10000 hits from Elasticsearch 7.
+type hitsTotal int64
+
+func (t *hitsTotal) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*t = hitsTotal(n)
+		return nil
+	}
+	var total struct {
+		Value int64 `json:"value"`
+	}
+	if err := json.Unmarshal(data, &total); err != nil {
+		return err
+	}
+	*t = hitsTotal(total.Value)
+	return nil
+}
@@ -0,0 +1,126 @@
+package elasticsearch
+
+import (
+	"testing"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// searchResponse8 is a search response of Elasticsearch 8.11 against a time
+// series data stream, with track_total_hits and terminate_after set
+const searchResponse8 = `{
+  "took": 3,
+  "timed_out": false,
+  "terminated_early": true,
+  "_shards": {"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+  "hits": {
+    "total": {"value": 12001, "relation": "eq"},
+    "max_score": null,
+    "hits": [
+      {
+        "_index": ".ds-prometheus-2023.11.20-000001",
+        "_id": "Jd1x7nFmV3kAAAGL7YPoAA",
+        "_score": null,
+        "_source": {
+          "label": {"__name__": "up", "job": "node"},
+          "fingerprint": "a7c2d4e1b0f39c58",
+          "value": 1,
+          "timestamp": 1700489100000,
+          "@timestamp": 1700489100000
+        },
+        "sort": [1700489100000]
+      },
+      {
+        "_index": ".ds-prometheus-2023.11.20-000001",
+        "_id": "Jd1x7nFmV3kAAAGL7Y0g4A",
+        "_score": null,
+        "_source": {
+          "label": {"__name__": "up", "job": "node"},
+          "fingerprint": "a7c2d4e1b0f39c58",
+          "stale": true,
+          "timestamp": 1700489160000,
+          "@timestamp": 1700489160000
+        },
+        "sort": [1700489160000]
+      }
+    ]
+  }
+}`
+
+// searchResponse6 is a search response of Elasticsearch 6.8
+const searchResponse6 = `{
+  "took": 2,
+  "timed_out": false,
+  "_shards": {"total": 5, "successful": 5, "skipped": 0, "failed": 0},
+  "hits": {
+    "total": 1,
+    "max_score": null,
+    "hits": [
+      {
+        "_index": "prometheus-000001",
+        "_type": "sample",
+        "_id": "a7c2d4e1b0f39c58-1700489100000",
+        "_score": null,
+        "_source": {
+          "label": {"__name__": "up", "job": "node"},
+          "fingerprint": "a7c2d4e1b0f39c58",
+          "value": 1,
+          "timestamp": 1700489100000
+        },
+        "sort": [1700489100000]
+      }
+    ]
+  }
+}`
+
+func TestDecodeSearchResult(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		total           int64
+		hits            int
+		terminatedEarly bool
+	}{
+		{"8.x", searchResponse8, 12001, 2, true},
+		{"6.x", searchResponse6, 1, 1, false},
+		{"no hits", `{"took": 1, "hits": {"total": {"value": 0, "relation": "eq"}}}`, 0, 0, false},
+	}
+	for _, test := range tests {
+		resp, err := decodeSearchResult([]byte(test.body))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if resp.Hits == nil {
+			t.Errorf("%s: hits not decoded", test.name)
+			continue
+		}
+		if resp.Hits.TotalHits != test.total || len(resp.Hits.Hits) != test.hits || resp.TerminatedEarly != test.terminatedEarly {
+			t.Errorf("%s: got %d total, %d hits, terminated early %t, want %d, %d, %t", test.name,
+				resp.Hits.TotalHits, len(resp.Hits.Hits), resp.TerminatedEarly, test.total, test.hits, test.terminatedEarly)
+		}
+		for _, hit := range resp.Hits.Hits {
+			if _, err := decodeSample(hit, false); err != nil {
+				t.Errorf("%s: %s: %s", test.name, hit.Id, err)
+			}
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	var resp elastic.SearchResult
+	if err := new(Decoder).Decode([]byte(searchResponse8), &resp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.TotalHits() != 12001 || len(resp.Hits.Hits) != 2 || resp.ScrollId != "" || resp.TookInMillis != 3 {
+		t.Errorf("got %d total, %d hits, took %d", resp.TotalHits(), len(resp.Hits.Hits), resp.TookInMillis)
+	}
+
+	// other responses decode as with the default decoder
+	var other struct {
+		Acknowledged bool `json:"acknowledged"`
+	}
+	if err := new(Decoder).Decode([]byte(`{"acknowledged": true}`), &other); err != nil || !other.Acknowledged {
+		t.Errorf("got %v, %v", other, err)
+	}
+}
@@ -0,0 +1,84 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// sampleDocvalueFields are fetched instead of _source when reading samples
+// from indices created with the optimized profile, which do not store it
+var sampleDocvalueFields = []elastic.DocvalueField{
+	{Field: labelPrefix + "*", Format: "use_field_mapping"},
+	{Field: "fingerprint", Format: "use_field_mapping"},
+	{Field: "value", Format: "use_field_mapping"},
+	{Field: "stale", Format: "use_field_mapping"},
+	{Field: "special", Format: "use_field_mapping"},
+	{Field: "timestamp", Format: "epoch_millis"},
+}
+
+// decodeSample decodes a sample search hit, from its doc values when
+// docValues is set and from its _source otherwise
+func decodeSample(hit *elastic.SearchHit, docValues bool) (*prometheusSample, error) {
+	var s prometheusSample
+	if !docValues {
+		if hit.Source == nil {
+			return nil, fmt.Errorf("document has no source")
+		}
+		if err := json.Unmarshal(*hit.Source, &s); err != nil {
+			return nil, err
+		}
+		return &s, nil
+	}
+
+	doc := sampleDoc{Labels: make(model.Metric)}
+	for field, values := range hit.Fields {
+		list, isList := values.([]interface{})
+		if !isList || len(list) == 0 {
+			continue
+		}
+		v := list[0]
+		ok := true
+		switch {
+		case strings.HasPrefix(field, labelPrefix):
+			var value string
+			value, ok = v.(string)
+			doc.Labels[model.LabelName(strings.TrimPrefix(field, labelPrefix))] = model.LabelValue(value)
+		case field == "fingerprint":
+			doc.Fingerprint, ok = v.(string)
+		case field == "value":
+			var value float64
+			value, ok = v.(float64)
+			doc.Value = &value
+		case field == "stale":
+			doc.Stale, ok = v.(bool)
+		case field == "special":
+			doc.Special, ok = v.(string)
+		case field == "timestamp":
+			doc.Timestamp, ok = docvalueInt(v)
+		}
+		if !ok {
+			return nil, fmt.Errorf("unexpected doc value %v for field %s", v, field)
+		}
+	}
+	if err := s.fromDoc(&doc); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// docvalueInt converts a numeric doc value, which is a string when formatted
+func docvalueInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int64(n), true
+	case string:
+		i, err := strconv.ParseInt(n, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,382 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// rollupSample is a document summarising the raw samples of a series within
+// one resolution bucket
+type rollupSample struct {
+	Labels         model.Metric  `json:"label"`
+	Fingerprint    string        `json:"fingerprint"`
+	Timestamp      int64         `json:"timestamp"`
+	Min            float64       `json:"min"`
+	Max            float64       `json:"max"`
+	Sum            float64       `json:"sum"`
+	Count          int64         `json:"count"`
+	First          float64       `json:"first"`
+	FirstTimestamp int64         `json:"first_timestamp"`
+	Last           float64       `json:"last"`
+	LastTimestamp  int64         `json:"last_timestamp"`
+	Counter        bool          `json:"counter,omitempty"`
+	Resets         []rollupPoint `json:"resets,omitempty"`
+}
+
+// rollupPoint is a raw sample kept in a rollup
+type rollupPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// add folds a raw sample into the rollup.  Samples must be added in timestamp
+// order so that counter resets can be detected.
+func (r *rollupSample) add(s *prometheusSample) {
+	if r.Count == 0 {
+		r.Min, r.Max = s.Value, s.Value
+		r.First, r.FirstTimestamp = s.Value, s.Timestamp
+	} else if r.Counter && s.Value < r.Last {
+		// keep the samples either side of a reset so rate and increase over
+		// the rollup see it exactly as they would over the raw samples
+		r.Resets = append(r.Resets,
+			rollupPoint{Timestamp: r.LastTimestamp, Value: r.Last},
+			rollupPoint{Timestamp: s.Timestamp, Value: s.Value})
+	}
+	r.Min = math.Min(r.Min, s.Value)
+	r.Max = math.Max(r.Max, s.Value)
+	r.Sum += s.Value
+	r.Count++
+	if s.Timestamp >= r.LastTimestamp {
+		r.Last = s.Value
+		r.LastTimestamp = s.Timestamp
+	}
+}
+
+// counterSuffixes identify counters by the Prometheus naming conventions, as
+// remote write requests carry no metric metadata
+var counterSuffixes = []string{"_total", "_count", "_sum", "_bucket"}
+
+// isCounter reports whether a series looks like a counter
+func isCounter(m model.Metric) bool {
+	name := string(m[model.MetricNameLabel])
+	for _, suffix := range counterSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DownsampleService periodically rolls raw samples up into coarser resolution
+// indices named <alias>-<resolution>-<date>
+type DownsampleService struct {
+	ctx    context.Context
+	client *elastic.Client
+	config *DownsampleConfig
+	logger *zap.Logger
+}
+
+// DownsampleConfig is used to configure DownsampleService
+type DownsampleConfig struct {
+	Alias       string
+	Resolutions []time.Duration
+	Shards      int
+	Replicas    int
+	// Delay is how long to wait for late samples before rolling up a bucket
+	Delay time.Duration
+	// Lookback is how far back to start when no rollups exist yet
+	Lookback time.Duration
+	// Interval is the period between downsampling runs
+	Interval time.Duration
+	// BatchSize is the number of documents read and written per request
+	BatchSize int
+	// DocValues reads raw samples from doc values, see ReadConfig
+	DocValues bool
+	// RoutingKey sets the shard routing of rollups, which must match that of
+	// the raw samples as reads route both alike
+	RoutingKey string
+}
+
+// NewDownsampleService will ensure the rollup index template exists and start
+// downsampling raw samples in the background
+func NewDownsampleService(ctx context.Context, logger *zap.Logger, client *elastic.Client, config *DownsampleConfig) (*DownsampleService, error) {
+	svc := &DownsampleService{
+		ctx:    ctx,
+		client: client,
+		config: config,
+		logger: logger,
+	}
+	if err := svc.ensureTemplate(); err != nil {
+		return nil, err
+	}
+	go svc.run()
+	return svc, nil
+}
+
+// rollupAlias is the prefix of the indices holding rollups at a resolution
+func rollupAlias(alias string, resolution time.Duration) string {
+	return alias + "-" + resolutionName(resolution)
+}
+
+// resolutionName formats a resolution the way it appears in index names, eg 5m or 1h
+func resolutionName(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+// ParseResolutions parses a comma separated list of durations such as "5m,1h"
+func ParseResolutions(s string) ([]time.Duration, error) {
+	var resolutions []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second || d%time.Second != 0 {
+			return nil, fmt.Errorf("invalid resolution %s", part)
+		}
+		resolutions = append(resolutions, d)
+	}
+	return resolutions, nil
+}
+
+// rollupPatterns match the rollup indices of an alias, which share the
+// prefix of its raw sample indices
+func rollupPatterns(alias string, resolutions []time.Duration) []string {
+	var patterns []string
+	for _, res := range resolutions {
+		patterns = append(patterns, rollupAlias(alias, res)+"-*")
+	}
+	return patterns
+}
+
+// rawIndexPatterns match the raw sample indices of an alias, leaving out its
+// rollup indices
+func rawIndexPatterns(alias string, resolutions []time.Duration) []string {
+	patterns := []string{alias + "-*"}
+	for _, p := range rollupPatterns(alias, resolutions) {
+		patterns = append(patterns, "-"+p)
+	}
+	return patterns
+}
+
+// isRollupIndex reports whether index is a rollup index of alias at any
+// resolution, configured or not
+func isRollupIndex(alias, index string) bool {
+	rest := strings.TrimPrefix(index, alias+"-")
+	i := strings.IndexByte(rest, '-')
+	if rest == index || i < 0 {
+		return false
+	}
+	if _, err := time.ParseDuration(rest[:i]); err != nil {
+		return false
+	}
+	_, err := time.Parse(dailyIndexFormat, rest[i+1:])
+	return err == nil
+}
+
+func (svc *DownsampleService) ensureTemplate() error {
+	var buf bytes.Buffer
+	t := template.Must(template.New("rollup").Parse(rollupTemplate))
+	err := t.Execute(&buf, struct {
+		Patterns []string
+		Shards   int
+		Replicas int
+	}{rollupPatterns(svc.config.Alias, svc.config.Resolutions), svc.config.Shards, svc.config.Replicas})
+	if err != nil {
+		return fmt.Errorf("executing template: %s", err)
+	}
+
+	_, err = svc.client.IndexPutTemplate(svc.config.Alias + "-rollup").BodyString(buf.String()).Do(svc.ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to create rollup index template: %s", err)
+	}
+	return nil
+}
+
+func (svc *DownsampleService) run() {
+	watermarks := make(map[time.Duration]int64)
+	for {
+		for _, res := range svc.config.Resolutions {
+			wm, err := svc.downsample(res, watermarks[res])
+			if err != nil {
+				svc.logger.Error("Failed to downsample", zap.String("resolution", res.String()), zap.Error(err))
+			}
+			watermarks[res] = wm
+		}
+		select {
+		case <-time.After(svc.config.Interval):
+		case <-svc.ctx.Done():
+			svc.logger.Info("Downsample service exiting")
+			return
+		}
+	}
+}
+
+// chunkSize is the time range of raw samples rolled up at once
+func chunkSize(res time.Duration) int64 {
+	return int64(12 * res / time.Millisecond)
+}
+
+// downsample rolls up every complete chunk from the watermark, which is
+// discovered from the existing rollups when zero, and returns the new watermark
+func (svc *DownsampleService) downsample(res time.Duration, watermark int64) (int64, error) {
+	chunk := chunkSize(res)
+	if watermark == 0 {
+		wm, err := svc.discoverWatermark(res)
+		if err != nil {
+			return 0, err
+		}
+		watermark = wm
+	}
+	nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+	end := (nowMs - int64(svc.config.Delay/time.Millisecond)) / chunk * chunk
+	for watermark+chunk <= end {
+		if err := svc.rollup(res, watermark, watermark+chunk); err != nil {
+			return watermark, err
+		}
+		watermark += chunk
+	}
+	return watermark, nil
+}
+
+// discoverWatermark resumes from the chunk holding the latest rollup, redoing
+// it in case it was only partially written
+func (svc *DownsampleService) discoverWatermark(res time.Duration) (int64, error) {
+	chunk := chunkSize(res)
+	resp, err := svc.client.Search().
+		Index(rollupAlias(svc.config.Alias, res)+"-*").
+		IgnoreUnavailable(true).
+		Size(0).
+		Aggregation("latest", elastic.NewMaxAggregation().Field("timestamp")).
+		Do(svc.ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to discover rollup watermark: %s", err)
+	}
+	if latest, ok := resp.Aggregations.Max("latest"); ok && latest.Value != nil {
+		return int64(*latest.Value) / chunk * chunk, nil
+	}
+	nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+	return (nowMs - int64(svc.config.Lookback/time.Millisecond)) / chunk * chunk, nil
+}
+
+// rollup summarises the raw samples between start (inclusive) and end
+// (exclusive) into resolution buckets.  Rollup documents have deterministic
+// ids so that reprocessing a chunk overwrites rather than duplicates them.
+func (svc *DownsampleService) rollup(res time.Duration, start, end int64) error {
+	step := int64(res / time.Millisecond)
+	buckets := make(map[string]map[int64]*rollupSample)
+
+	source := elastic.NewSearchSource().
+		Query(elastic.NewRangeQuery("timestamp").Gte(start).Lt(end)).
+		Sort("timestamp", true)
+	if svc.config.DocValues {
+		source = source.FetchSource(false).DocvalueFieldsWithFormat(sampleDocvalueFields...)
+	}
+	scroll := svc.client.Scroll(rawIndexPatterns(svc.config.Alias, svc.config.Resolutions)...).
+		Type(sampleType).
+		IgnoreUnavailable(true).
+		SearchSource(source).
+		Size(svc.config.BatchSize)
+	defer scroll.Clear(context.Background())
+	for {
+		resp, err := scroll.Do(svc.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to scroll raw samples: %s", err)
+		}
+		for _, hit := range resp.Hits.Hits {
+			s, err := decodeSample(hit, svc.config.DocValues)
+			if err != nil {
+				svc.logger.Warn("Failed to decode sample", zap.String("index", hit.Index), zap.String("id", hit.Id), zap.Error(err))
+				downsampleUndecodedTotal.Inc()
+				continue
+			}
+			// rollup documents hold plain doubles, so staleness markers and
+			// other special values are left to the raw samples
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				continue
+			}
+			fingerprint := s.Labels.Fingerprint().String()
+			series, ok := buckets[fingerprint]
+			if !ok {
+				series = make(map[int64]*rollupSample)
+				buckets[fingerprint] = series
+			}
+			bucket := s.Timestamp / step * step
+			r, ok := series[bucket]
+			if !ok {
+				r = &rollupSample{
+					Labels:      s.Labels,
+					Fingerprint: fingerprint,
+					Timestamp:   bucket,
+					Counter:     isCounter(s.Labels),
+				}
+				series[bucket] = r
+			}
+			r.add(s)
+		}
+	}
+
+	bulk := svc.client.Bulk()
+	var written int
+	for fingerprint, series := range buckets {
+		for bucket, r := range series {
+			bulk.Add(elastic.NewBulkIndexRequest().
+				Index(dailyIndexName(rollupAlias(svc.config.Alias, res), bucket)).
+				Type(sampleType).
+				Id(fmt.Sprintf("%s-%d", fingerprint, bucket)).
+				Routing(documentRouting(svc.config.RoutingKey, r.Labels, fingerprint)).
+				Doc(r))
+			if bulk.NumberOfActions() >= svc.config.BatchSize {
+				if err := svc.flush(bulk); err != nil {
+					return err
+				}
+			}
+			written++
+		}
+	}
+	if bulk.NumberOfActions() > 0 {
+		if err := svc.flush(bulk); err != nil {
+			return err
+		}
+	}
+	svc.logger.Debug("Rolled up samples",
+		zap.String("resolution", res.String()),
+		zap.Int64("start", start),
+		zap.Int64("end", end),
+		zap.Int("rollups", written))
+	return nil
+}
+
+func (svc *DownsampleService) flush(bulk *elastic.BulkService) error {
+	resp, err := bulk.Do(svc.ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to write rollups: %s", err)
+	}
+	if failed := resp.Failed(); len(failed) > 0 {
+		return fmt.Errorf("Failed to write %d rollups: %+v", len(failed), failed[0].Error)
+	}
+	return nil
+}
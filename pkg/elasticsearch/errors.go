@@ -0,0 +1,77 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"net/http"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// ReadErrorKind classifies the failures reported by ReadService
+type ReadErrorKind int
+
+const (
+	// ErrBadRequest indicates the query itself is invalid
+	ErrBadRequest ReadErrorKind = iota
+	// ErrStorage indicates Elasticsearch failed to serve the query
+	ErrStorage
+	// ErrPartialData indicates some documents could not be decoded and were
+	// left out of an otherwise successful result
+	ErrPartialData
+	// ErrLimitExceeded indicates the query was refused or aborted because it
+	// exceeded one of the configured query limits
+	ErrLimitExceeded
+)
+
+func (k ReadErrorKind) String() string {
+	switch k {
+	case ErrBadRequest:
+		return "bad_request"
+	case ErrStorage:
+		return "storage"
+	case ErrPartialData:
+		return "partial_data"
+	case ErrLimitExceeded:
+		return "limit_exceeded"
+	}
+	return "unknown"
+}
+
+// ReadError is the error type returned by ReadService
+type ReadError struct {
+	Kind ReadErrorKind
+	Err  error
+}
+
+func (e *ReadError) Error() string {
+	return e.Err.Error()
+}
+
+func isPartialData(err error) bool {
+	e, ok := err.(*ReadError)
+	return ok && e.Kind == ErrPartialData
+}
+
+// badRequest wraps err as an ErrBadRequest ReadError
+func badRequest(err error) error {
+	return &ReadError{Kind: ErrBadRequest, Err: err}
+}
+
+// storageError classifies an error returned by Elasticsearch.  Requests that
+// Elasticsearch rejected as malformed are reported as bad requests.
+func storageError(err error) error {
+	if _, ok := err.(*ReadError); ok {
+		return err
+	}
+	if elastic.IsStatusCode(err, http.StatusBadRequest) {
+		return &ReadError{Kind: ErrBadRequest, Err: err}
+	}
+	return &ReadError{Kind: ErrStorage, Err: err}
+}
+
+// limitExceeded records that a query limit was hit and returns an
+// ErrLimitExceeded ReadError
+func limitExceeded(limit string, format string, args ...interface{}) error {
+	limitsExceededTotal.WithLabelValues(limit).Inc()
+	return &ReadError{Kind: ErrLimitExceeded, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,160 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// Export streams the raw samples of the series selected by matchers between
+// start and end, inclusive, to fn one series at a time.  Unlike Read it
+// scrolls through every matching document, so neither the read limits, cache
+// nor rollups apply.  Series are passed in metric name order, each once with
+// its samples in timestamp order, so the samples of one metric name are held
+// in memory at a time.  Documents which cannot be decoded are skipped and
+// reported through an ErrPartialData error once the export is complete.
+func (svc *ReadService) Export(ctx context.Context, matchers []*prompb.LabelMatcher, start, end int64, fn func(*prompb.TimeSeries) error) error {
+	indices, err := svc.resolve(ctx, matchers, timeRange{start: start, end: end})
+	if err != nil {
+		return storageError(err)
+	}
+	if len(indices) == 0 {
+		return nil
+	}
+	query, filters, err := svc.buildQuery(matchers, start, end)
+	if err != nil {
+		return err
+	}
+	// documents written before fingerprints were stored lack the field, so
+	// series are told apart by their labels instead
+	source := elastic.NewSearchSource().
+		Query(query).
+		SortBy(
+			elastic.NewFieldSort(labelPrefix+"__name__").UnmappedType("keyword"),
+			elastic.NewFieldSort("timestamp"))
+	if svc.config.DocValues {
+		source = source.FetchSource(false).DocvalueFieldsWithFormat(sampleDocvalueFields...)
+	}
+	scroll := svc.client.Scroll(indices...).
+		IgnoreUnavailable(true).
+		SearchSource(source).
+		Size(svc.config.MaxDocs)
+	if !IsDataStream(svc.config.Storage) {
+		scroll = scroll.Type(sampleType)
+	}
+	if routing := queryRouting(svc.config.RoutingKey, matchers); routing != "" {
+		scroll = scroll.Routing(routing)
+	}
+	defer scroll.Clear(context.Background())
+
+	g := newSeriesGrouper(filters, fn)
+	var skipped int
+	for {
+		resp, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return storageError(err)
+		}
+		for _, hit := range resp.Hits.Hits {
+			s, err := decodeSample(hit, svc.config.DocValues)
+			if err != nil {
+				svc.logger.Warn("Failed to decode sample", zap.String("index", hit.Index), zap.String("id", hit.Id), zap.Error(err))
+				skipped++
+				continue
+			}
+			if err := g.add(s); err != nil {
+				return err
+			}
+		}
+	}
+	if err := g.flush(); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		return &ReadError{
+			Kind: ErrPartialData,
+			Err:  fmt.Errorf("%d samples could not be decoded", skipped),
+		}
+	}
+	return nil
+}
+
+// seriesGrouper collects samples arriving in metric name then timestamp order
+// into series, passing the series of a metric name to fn once the next name
+// starts
+type seriesGrouper struct {
+	filters []*labelFilter
+	fn      func(*prompb.TimeSeries) error
+	name    model.LabelValue
+	series  map[model.Fingerprint]*prompb.TimeSeries
+}
+
+func newSeriesGrouper(filters []*labelFilter, fn func(*prompb.TimeSeries) error) *seriesGrouper {
+	return &seriesGrouper{
+		filters: filters,
+		fn:      fn,
+		series:  make(map[model.Fingerprint]*prompb.TimeSeries),
+	}
+}
+
+func (g *seriesGrouper) add(s *prometheusSample) error {
+	if name := s.Labels[model.MetricNameLabel]; name != g.name {
+		if err := g.flush(); err != nil {
+			return err
+		}
+		g.name = name
+	}
+	fingerprint := s.Labels.Fingerprint()
+	ts, ok := g.series[fingerprint]
+	if !ok {
+		// series left out by the filters are kept as nil
+		if matchesFilters(s.Labels, g.filters) {
+			ts = &prompb.TimeSeries{Labels: make([]*prompb.Label, 0, len(s.Labels))}
+			for k, v := range s.Labels {
+				ts.Labels = append(ts.Labels, &prompb.Label{
+					Name:  string(k),
+					Value: string(v),
+				})
+			}
+		}
+		g.series[fingerprint] = ts
+	}
+	if ts == nil {
+		return nil
+	}
+	// the same sample may be stored in more than one index
+	if n := len(ts.Samples); n > 0 && ts.Samples[n-1].Timestamp == s.Timestamp {
+		return nil
+	}
+	ts.Samples = append(ts.Samples, prompb.Sample{
+		Value:     s.Value,
+		Timestamp: s.Timestamp,
+	})
+	return nil
+}
+
+// flush passes the collected series to fn in fingerprint order
+func (g *seriesGrouper) flush() error {
+	fingerprints := make([]model.Fingerprint, 0, len(g.series))
+	for fingerprint, ts := range g.series {
+		if ts != nil {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	sort.Slice(fingerprints, func(i, j int) bool { return fingerprints[i] < fingerprints[j] })
+	for _, fingerprint := range fingerprints {
+		if err := g.fn(g.series[fingerprint]); err != nil {
+			return err
+		}
+	}
+	g.series = make(map[model.Fingerprint]*prompb.TimeSeries)
+	return nil
+}
@@ -0,0 +1,96 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// exportSeries groups documents as Export does, returning the series with
+// their labels in the Prometheus notation
+func exportSeries(t *testing.T, filters []*labelFilter, docs []string) map[string][]prompb.Sample {
+	t.Helper()
+	series := make(map[string][]prompb.Sample)
+	var names []model.LabelValue
+	g := newSeriesGrouper(filters, func(ts *prompb.TimeSeries) error {
+		m := make(model.Metric, len(ts.Labels))
+		for _, l := range ts.Labels {
+			m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		if _, ok := series[m.String()]; ok {
+			t.Errorf("series %s passed more than once", m)
+		}
+		series[m.String()] = ts.Samples
+		names = append(names, m[model.MetricNameLabel])
+		return nil
+	})
+	for _, doc := range docs {
+		var s prometheusSample
+		if err := json.Unmarshal([]byte(doc), &s); err != nil {
+			t.Fatalf("%s: %s", doc, err)
+		}
+		if err := g.add(&s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i] < names[i-1] {
+			t.Errorf("series of %s passed after %s", names[i], names[i-1])
+		}
+	}
+	return series
+}
+
+func TestExportLegacyDocuments(t *testing.T) {
+	// documents written before fingerprints were stored, in the metric name
+	// then timestamp order Export scrolls them in, the series interleaved
+	docs := []string{
+		`{"label":{"__name__":"load","host":"a"},"value":1,"timestamp":1000}`,
+		`{"label":{"__name__":"load","host":"b"},"value":2,"timestamp":1000}`,
+		`{"label":{"__name__":"load","host":"a"},"value":3,"timestamp":2000}`,
+		`{"label":{"__name__":"load","host":"a"},"value":3,"timestamp":2000}`,
+		`{"label":{"__name__":"load","host":"b"},"value":4,"timestamp":2000,"fingerprint":"stale"}`,
+		`{"label":{"__name__":"up","host":"a"},"value":1,"timestamp":500}`,
+		`{"label":{"__name__":"up","host":"a"},"stale":true,"timestamp":1500}`,
+	}
+	got := exportSeries(t, nil, docs)
+	want := map[string][]prompb.Sample{
+		`load{host="a"}`: {{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 3}},
+		`load{host="b"}`: {{Timestamp: 1000, Value: 2}, {Timestamp: 2000, Value: 4}},
+	}
+	up := got[`up{host="a"}`]
+	delete(got, `up{host="a"}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(up) != 2 || up[0].Value != 1 || !isStaleNaN(up[1].Value) {
+		t.Errorf("got up samples %v, want 1 then a staleness marker", up)
+	}
+}
+
+func TestExportFilters(t *testing.T) {
+	docs := []string{
+		`{"label":{"__name__":"load","host":"a"},"value":1,"timestamp":1000}`,
+		`{"label":{"__name__":"load","host":"b"},"value":2,"timestamp":1000}`,
+		`{"label":{"__name__":"load"},"value":3,"timestamp":1000}`,
+	}
+	filters := []*labelFilter{{
+		name: "host",
+		re:   regexp.MustCompile(`^(?:b|)$`),
+	}}
+	got := exportSeries(t, filters, docs)
+	want := map[string][]prompb.Sample{
+		`load{host="b"}`: {{Timestamp: 1000, Value: 2}},
+		`load`:           {{Timestamp: 1000, Value: 3}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,49 @@
+package elasticsearch
+
+import (
+	"sync"
+	"time"
+)
+
+// haTracker elects one replica per cluster of Prometheus HA pairs to accept
+// samples from.  The election fails over to another replica once the elected
+// one has not written for the failover timeout.
+type haTracker struct {
+	failover time.Duration
+
+	mu       sync.Mutex
+	clusters map[string]*haElection
+}
+
+type haElection struct {
+	replica  string
+	lastSeen time.Time
+}
+
+func newHATracker(failover time.Duration) *haTracker {
+	return &haTracker{
+		failover: failover,
+		clusters: make(map[string]*haElection),
+	}
+}
+
+// accept reports whether samples written by replica of cluster at now should
+// be stored, electing replica when the cluster has no live elected replica
+func (t *haTracker) accept(cluster, replica string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.clusters[cluster]
+	if !ok {
+		t.clusters[cluster] = &haElection{replica: replica, lastSeen: now}
+		return true
+	}
+	if e.replica != replica {
+		if now.Sub(e.lastSeen) <= t.failover {
+			return false
+		}
+		e.replica = replica
+		haFailoversTotal.Inc()
+	}
+	e.lastSeen = now
+	return true
+}
@@ -27,11 +27,20 @@ type IndexConfig struct {
 	MaxSize string
 }
 
+// Index template profiles
+const (
+	ProfileDefault   = "default"
+	ProfileOptimized = "optimized"
+)
+
 // IndexTemplateConfig is used to resolve template
 type IndexTemplateConfig struct {
 	Alias    string
 	Shards   int
 	Replicas int
+	// Profile selects the default template or the optimized one, whose
+	// indices must be read with ReadConfig.DocValues
+	Profile string
 }
 
 // NewIndexService will ensure required alias and indexes exist.  It will also monitor
@@ -51,8 +60,17 @@ func NewIndexService(ctx context.Context, logger *zap.Logger, client *elastic.Cl
 }
 
 func EnsureIndexTemplate(ctx context.Context, client *elastic.Client, config *IndexTemplateConfig) error {
+	var text string
+	switch config.Profile {
+	case ProfileDefault, "":
+		text = indexTemplate
+	case ProfileOptimized:
+		text = optimizedIndexTemplate
+	default:
+		return fmt.Errorf("unknown index profile %q", config.Profile)
+	}
 	var buf bytes.Buffer
-	t := template.Must(template.New("template").Parse(indexTemplate))
+	t := template.Must(template.New("template").Parse(text))
 	err := t.Execute(&buf, config)
 	if err != nil {
 		return fmt.Errorf("executing template: %s", err)
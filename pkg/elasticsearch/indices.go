@@ -0,0 +1,208 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	dailyIndexFormat = "2006-01-02"
+	// maxSearchIndices caps the number of indices named explicitly in a search
+	// before falling back to the alias wildcard, keeping request lines short
+	maxSearchIndices = 64
+	day              = int64(24 * time.Hour / time.Millisecond)
+)
+
+// indexBounds holds the min and max sample timestamps of an index
+type indexBounds struct {
+	name     string
+	min, max int64
+}
+
+// indexResolver selects the indices of an alias which may contain samples in a
+// given time range.  The indices behind the alias are listed every refresh and
+// the bounds of rolled over ones discovered once with min/max aggregations,
+// daily indices are resolved by name.
+type indexResolver struct {
+	client  *elastic.Client
+	alias   string
+	daily   bool
+	refresh time.Duration
+	// exclude lists patterns of indices sharing the alias prefix which must
+	// not be searched
+	exclude []string
+	// dataStream resolves to the data stream named after the alias, which
+	// prunes its backing indices by time itself
+	dataStream bool
+
+	mu      sync.Mutex
+	fetched time.Time
+	// bounds holds the indices the alias no longer points at, which receive
+	// no more samples, so their bounds are only aggregated once.  The indices
+	// the alias points at are searched through the alias.
+	bounds []indexBounds
+}
+
+func newIndexResolver(client *elastic.Client, alias string, daily bool, refresh time.Duration, exclude []string) *indexResolver {
+	return &indexResolver{
+		client:  client,
+		alias:   alias,
+		daily:   daily,
+		refresh: refresh,
+		exclude: exclude,
+	}
+}
+
+// patterns match every index of the alias
+func (r *indexResolver) patterns() []string {
+	if r.dataStream {
+		return []string{r.alias}
+	}
+	patterns := []string{r.alias + "-*"}
+	for _, e := range r.exclude {
+		patterns = append(patterns, "-"+e)
+	}
+	return patterns
+}
+
+// indices returns the indices to search for samples between start and end.
+// An empty result means no index can hold matching samples.
+func (r *indexResolver) indices(ctx context.Context, start, end int64) ([]string, error) {
+	if r.refresh <= 0 || r.dataStream {
+		return r.patterns(), nil
+	}
+	if r.daily {
+		return r.dailyIndices(start, end), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.fetched) > r.refresh {
+		if err := r.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	selected := []string{r.alias}
+	for _, b := range r.bounds {
+		if b.min <= end && b.max >= start {
+			selected = append(selected, b.name)
+		}
+	}
+	if len(selected) > maxSearchIndices {
+		return r.patterns(), nil
+	}
+	return selected, nil
+}
+
+// dailyIndices derives the index names from the dates spanned by the range,
+// widened by a day either side as the write path names indices in local time
+func (r *indexResolver) dailyIndices(start, end int64) []string {
+	if start <= 0 || end == math.MaxInt64 || (end-start)/day+3 > maxSearchIndices {
+		return r.patterns()
+	}
+	var selected []string
+	for ts := start - day; ts <= end+day; ts += day {
+		selected = append(selected, dailyIndexName(r.alias, ts))
+	}
+	if last := dailyIndexName(r.alias, end+day); last != selected[len(selected)-1] {
+		selected = append(selected, last)
+	}
+	return selected
+}
+
+// fetch refreshes the bounds of the indices behind the alias, aggregating
+// only those of indices which are new or which the alias pointed at before.
+// An index rolled over since the last fetch leaves the alias, so is only
+// searched again once the next fetch has aggregated its bounds.
+func (r *indexResolver) fetch(ctx context.Context) error {
+	aliases, err := r.client.Aliases().Index(r.alias).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return fmt.Errorf("Failed to resolve alias %s: %s", r.alias, err)
+	}
+	write := make(map[string]bool)
+	if aliases != nil {
+		for _, name := range aliases.IndicesByAlias(r.alias) {
+			write[name] = true
+		}
+	}
+	settings, err := r.client.IndexGetSettings(r.patterns()...).
+		IgnoreUnavailable(true).
+		Name("index.creation_date").
+		Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return fmt.Errorf("Failed to list indices of %s: %s", r.alias, err)
+	}
+
+	known := make(map[string]indexBounds, len(r.bounds))
+	for _, b := range r.bounds {
+		known[b.name] = b
+	}
+	var bounds []indexBounds
+	var unknown []string
+	for name := range settings {
+		switch b, ok := known[name]; {
+		case write[name]:
+		case ok:
+			// deleted indices drop out here
+			bounds = append(bounds, b)
+		default:
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		fetched, err := r.aggregateBounds(ctx, unknown)
+		if err != nil {
+			return err
+		}
+		bounds = append(bounds, fetched...)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].min < bounds[j].min })
+
+	r.bounds = bounds
+	r.fetched = time.Now()
+	return nil
+}
+
+// aggregateBounds aggregates the min and max sample timestamps of indices.
+// Empty indices have no bounds and are aggregated again on the next fetch.
+func (r *indexResolver) aggregateBounds(ctx context.Context, indices []string) ([]indexBounds, error) {
+	resp, err := r.client.Search().
+		Index(indices...).
+		IgnoreUnavailable(true).
+		Size(0).
+		Aggregation("indices", elastic.NewTermsAggregation().
+			Field("_index").
+			Size(len(indices)).
+			SubAggregation("min", elastic.NewMinAggregation().Field("timestamp")).
+			SubAggregation("max", elastic.NewMaxAggregation().Field("timestamp"))).
+		Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to aggregate index bounds: %s", err)
+	}
+	var bounds []indexBounds
+	if agg, ok := resp.Aggregations.Terms("indices"); ok {
+		for _, b := range agg.Buckets {
+			min, minOk := b.Aggregations.Min("min")
+			max, maxOk := b.Aggregations.Max("max")
+			if !minOk || !maxOk || min.Value == nil || max.Value == nil {
+				continue
+			}
+			bounds = append(bounds, indexBounds{
+				name: fmt.Sprint(b.Key),
+				min:  int64(*min.Value),
+				max:  int64(*max.Value),
+			})
+		}
+	}
+	return bounds, nil
+}
+
+func dailyIndexName(alias string, ts int64) string {
+	return alias + "-" + time.Unix(ts/1000, 0).Format(dailyIndexFormat)
+}
@@ -0,0 +1,78 @@
+package elasticsearch
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const labelPrefix = "label."
+
+// LabelNames returns the sorted names of all labels stored under the configured alias
+func (svc *ReadService) LabelNames(ctx context.Context) ([]string, error) {
+	resp, err := svc.client.FieldCaps(svc.rawPatterns()...).
+		Fields(labelPrefix + "*").
+		IgnoreUnavailable(true).
+		AllowNoIndices(true).
+		Do(ctx)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	names := make([]string, 0, len(resp.Fields))
+	for field := range resp.Fields {
+		if !strings.HasPrefix(field, labelPrefix) {
+			continue
+		}
+		names = append(names, strings.TrimPrefix(field, labelPrefix))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LabelValues returns the sorted distinct values of a label across the samples
+// selected by matchers within the start and end timestamps (in milliseconds).
+// Values are collected with a composite aggregation, which returns them in
+// order while paging through high-cardinality labels MaxDocs buckets at a time.
+// Regex matchers that cannot be expressed in Lucene syntax are not applied, so
+// the values returned for them are a superset.
+func (svc *ReadService) LabelValues(ctx context.Context, name string, matchers []*prompb.LabelMatcher, start, end int64) ([]string, error) {
+	query, _, err := svc.buildQuery(matchers, start, end)
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	var after map[string]interface{}
+	for {
+		agg := elastic.NewCompositeAggregation().
+			Sources(elastic.NewCompositeAggregationTermsValuesSource("value").Field(labelPrefix + name)).
+			Size(svc.config.MaxDocs)
+		if after != nil {
+			agg = agg.AggregateAfter(after)
+		}
+		resp, err := svc.newSearch(svc.rawPatterns()...).
+			Query(query).
+			Size(0).
+			Aggregation("values", agg).
+			Do(ctx)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		res, ok := resp.Aggregations.Composite("values")
+		if !ok {
+			break
+		}
+		for _, b := range res.Buckets {
+			if v, ok := b.Key["value"].(string); ok {
+				values = append(values, v)
+			}
+		}
+		if len(res.Buckets) < svc.config.MaxDocs || len(res.AfterKey) == 0 {
+			break
+		}
+		after = res.AfterKey
+	}
+	return values, nil
+}
@@ -7,67 +7,66 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-const (
-	namespace = "es_adapter"
-)
+// Namespace prefixes the names of the metrics of the adapter
+const Namespace = "es_adapter"
 
 var (
 	flushedDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "flushed_total"),
+		prometheus.BuildFQName(Namespace, "", "flushed_total"),
 		"Number of times the flush interval has been invoked",
 		nil,
 		nil,
 	)
 	committedDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "committed_total"),
+		prometheus.BuildFQName(Namespace, "", "committed_total"),
 		"Number of times workers committed bulk requests",
 		nil,
 		nil,
 	)
 	indexedDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "indexed_total"),
+		prometheus.BuildFQName(Namespace, "", "indexed_total"),
 		"Number of requests indexed",
 		nil,
 		nil,
 	)
 	createdDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "created_total"),
+		prometheus.BuildFQName(Namespace, "", "created_total"),
 		"Number of requests that ES reported as creates (201)",
 		nil,
 		nil,
 	)
 	updatedDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "updated_total"),
+		prometheus.BuildFQName(Namespace, "", "updated_total"),
 		"Number of requests that ES reported as updates",
 		nil,
 		nil,
 	)
 	deletedDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "deleted_total"),
+		prometheus.BuildFQName(Namespace, "", "deleted_total"),
 		"Number of requests that ES reported as deletes",
 		nil,
 		nil,
 	)
 	succeededDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "succeeded_total"),
+		prometheus.BuildFQName(Namespace, "", "succeeded_total"),
 		"Number of requests that ES reported as successful",
 		nil,
 		nil,
 	)
 	failedDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "failed_total"),
+		prometheus.BuildFQName(Namespace, "", "failed_total"),
 		"Number of requests that ES reported as failed",
 		nil,
 		nil,
 	)
 	queuedDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "queued_total"),
+		prometheus.BuildFQName(Namespace, "", "queued_total"),
 		"Number of requests queued per worker",
 		[]string{"worker"},
 		nil,
 	)
 	durationDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "duration"),
+		prometheus.BuildFQName(Namespace, "", "duration"),
 		"Duration of last commit per worker",
 		[]string{"worker"},
 		nil,
@@ -112,3 +111,85 @@ func (svc *WriteService) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.MustNewConstMetric(durationDesc, prometheus.GaugeValue, float64(duration), strconv.Itoa(i))
 	}
 }
+
+var (
+	readErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "read_errors_total",
+			Help:      "Number of failed or partially failed read requests by kind",
+		},
+		[]string{"kind"},
+	)
+	limitsExceededTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "read_limits_exceeded_total",
+			Help:      "Number of read queries rejected for exceeding a query limit",
+		},
+		[]string{"limit"},
+	)
+	cacheRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "read_cache_requests_total",
+			Help:      "Number of read cache lookups by result",
+		},
+		[]string{"result"},
+	)
+	cacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "read_cache_bytes",
+			Help:      "Estimated size of the in-memory read cache",
+		},
+	)
+	haDroppedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "write_ha_dropped_samples_total",
+			Help:      "Number of samples dropped as written by a non-elected HA replica",
+		},
+	)
+	haFailoversTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "write_ha_failovers_total",
+			Help:      "Number of times a different HA replica was elected for a cluster",
+		},
+	)
+	rejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "write_rejected_samples_total",
+			Help:      "Number of samples rejected by reason",
+		},
+		[]string{"reason"},
+	)
+	activeSeries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "write_active_series",
+			Help:      "Number of series written per tenant within the series idle timeout",
+		},
+		[]string{"tenant"},
+	)
+	duplicatesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "write_duplicates_total",
+			Help:      "Number of samples ES rejected as already written (409)",
+		},
+	)
+	downsampleUndecodedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "downsample_undecoded_samples_total",
+			Help:      "Number of raw sample documents left out of rollups as they could not be decoded",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(readErrorsTotal, limitsExceededTotal, cacheRequestsTotal, cacheBytes, duplicatesTotal, haDroppedTotal, haFailoversTotal, rejectedTotal, activeSeries, downsampleUndecodedTotal)
+}
@@ -0,0 +1,283 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/ratelimit"
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// migrateTenant is the tenant migrated samples are written as
+const migrateTenant = "migrate"
+
+// MigrateConfig is used to configure Migrate
+type MigrateConfig struct {
+	// Alias, Storage and DocValues describe the source layout as for
+	// ReadConfig.  The rollup indices of Resolutions are not copied.
+	Alias       string
+	Storage     string
+	DocValues   bool
+	Resolutions []time.Duration
+	// Slices is the number of sliced scrolls reading the source in parallel
+	Slices int
+	// BatchSize is the number of samples read and written at once
+	BatchSize int
+	// Rate caps the samples copied per second, zero is unlimited
+	Rate float64
+	// Checkpoint is the file progress is saved to and resumed from, empty
+	// disables resuming
+	Checkpoint string
+}
+
+// migrateCheckpoint records, per slice, the timestamp up to which every
+// sample has been written to the target
+type migrateCheckpoint struct {
+	Slices     int     `json:"slices"`
+	Timestamps []int64 `json:"timestamps"`
+}
+
+type migration struct {
+	client  *elastic.Client
+	target  *WriteService
+	config  *MigrateConfig
+	logger  *zap.Logger
+	limiter *ratelimit.Limiter
+
+	// writeMu serializes the writes of slices, as a flush of the target
+	// reports the failures of every sample written since the last one
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	checkpoint migrateCheckpoint
+}
+
+// Migrate copies the raw samples of an alias into target, which may write to
+// another cluster, alias or storage layout.  Samples are read by parallel
+// sliced scrolls in timestamp order, and the progress of each slice is
+// checkpointed once its samples are flushed, so an interrupted migration
+// resumes where it stopped.  Samples at the checkpointed timestamp are copied
+// again on resume, which the deterministic ids of the target deduplicate.
+func Migrate(ctx context.Context, logger *zap.Logger, client *elastic.Client, target *WriteService, config *MigrateConfig) error {
+	if config.Storage == "" {
+		config.Storage = StorageIndex
+	}
+	if err := ValidateStorage(config.Storage); err != nil {
+		return err
+	}
+	if config.Slices < 1 {
+		config.Slices = 1
+	}
+	m := &migration{
+		client: client,
+		target: target,
+		config: config,
+		logger: logger,
+		checkpoint: migrateCheckpoint{
+			Slices:     config.Slices,
+			Timestamps: make([]int64, config.Slices),
+		},
+	}
+	if config.Rate > 0 {
+		m.limiter = ratelimit.New(config.Rate, config.BatchSize)
+	}
+	if err := m.load(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	for i := 0; i < config.Slices; i++ {
+		wg.Add(1)
+		go func(slice int) {
+			defer wg.Done()
+			if err := m.copySlice(ctx, slice); err != nil {
+				// stop the other slices, whose errors then only echo the
+				// cancellation
+				once.Do(func() {
+					first = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	return first
+}
+
+// patterns are the source indices, leaving out rollups
+func (m *migration) patterns() []string {
+	if IsDataStream(m.config.Storage) {
+		return []string{m.config.Alias}
+	}
+	return rawIndexPatterns(m.config.Alias, m.config.Resolutions)
+}
+
+func (m *migration) copySlice(ctx context.Context, slice int) error {
+	source := elastic.NewSearchSource().Sort("timestamp", true)
+	if from := m.resumeFrom(slice); from > 0 {
+		source = source.Query(elastic.NewRangeQuery("timestamp").Gte(from))
+	}
+	if m.config.DocValues {
+		source = source.FetchSource(false).DocvalueFieldsWithFormat(sampleDocvalueFields...)
+	}
+	if m.config.Slices > 1 {
+		source = source.Slice(elastic.NewSliceQuery().Id(slice).Max(m.config.Slices))
+	}
+	scroll := m.client.Scroll(m.patterns()...).
+		IgnoreUnavailable(true).
+		SearchSource(source).
+		Size(m.config.BatchSize)
+	if !IsDataStream(m.config.Storage) {
+		scroll = scroll.Type(sampleType)
+	}
+	defer scroll.Clear(context.Background())
+
+	var copied, skipped int
+	for {
+		resp, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to scroll slice %d: %s", slice, err)
+		}
+		tsMap := make(map[string]*prompb.TimeSeries)
+		var n int
+		var last int64
+		for _, hit := range resp.Hits.Hits {
+			s, err := decodeSample(hit, m.config.DocValues)
+			if err != nil {
+				m.logger.Warn("Failed to decode sample", zap.String("index", hit.Index), zap.String("id", hit.Id), zap.Error(err))
+				skipped++
+				continue
+			}
+			fingerprint := s.Labels.Fingerprint().String()
+			ts, ok := tsMap[fingerprint]
+			if !ok {
+				ts = &prompb.TimeSeries{Labels: make([]*prompb.Label, 0, len(s.Labels))}
+				for k, v := range s.Labels {
+					ts.Labels = append(ts.Labels, &prompb.Label{
+						Name:  string(k),
+						Value: string(v),
+					})
+				}
+				tsMap[fingerprint] = ts
+			}
+			ts.Samples = append(ts.Samples, prompb.Sample{
+				Value:     s.Value,
+				Timestamp: s.Timestamp,
+			})
+			last = s.Timestamp
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		if err := m.throttle(ctx, n); err != nil {
+			return err
+		}
+		series := make([]*prompb.TimeSeries, 0, len(tsMap))
+		for _, ts := range tsMap {
+			series = append(series, ts)
+		}
+		if err := m.write(slice, series, last); err != nil {
+			return err
+		}
+		copied += n
+		m.logger.Debug("Migrated samples", zap.Int("slice", slice), zap.Int("samples", copied), zap.Int64("timestamp", last))
+	}
+	m.logger.Info("Migrated slice",
+		zap.Int("slice", slice),
+		zap.Int("samples", copied),
+		zap.Int("skipped", skipped))
+	return nil
+}
+
+// write stores the series read by a slice in the target and, once flushed,
+// checkpoints the slice at timestamp
+func (m *migration) write(slice int, series []*prompb.TimeSeries, timestamp int64) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.target.Write(migrateTenant, series); err != nil {
+		return fmt.Errorf("Failed to write slice %d: %s", slice, err)
+	}
+	if err := m.target.Flush(); err != nil {
+		return fmt.Errorf("Failed to write slice %d: %s", slice, err)
+	}
+	return m.save(slice, timestamp)
+}
+
+// throttle waits until n samples may be written under the rate limit
+func (m *migration) throttle(ctx context.Context, n int) error {
+	if m.limiter == nil {
+		return nil
+	}
+	return m.limiter.Acquire(ctx, migrateTenant, n)
+}
+
+func (m *migration) resumeFrom(slice int) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkpoint.Timestamps[slice]
+}
+
+func (m *migration) load() error {
+	if m.config.Checkpoint == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(m.config.Checkpoint)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read migration checkpoint: %s", err)
+	}
+	var checkpoint migrateCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return fmt.Errorf("Failed to decode migration checkpoint: %s", err)
+	}
+	// slices partition documents differently depending on their number
+	if checkpoint.Slices != m.config.Slices || len(checkpoint.Timestamps) != m.config.Slices {
+		return fmt.Errorf("migration checkpoint was written with %d slices, resume with the same number", checkpoint.Slices)
+	}
+	m.checkpoint = checkpoint
+	m.logger.Info("Resuming migration", zap.String("checkpoint", m.config.Checkpoint))
+	return nil
+}
+
+// save records that every sample of a slice up to timestamp has been written
+func (m *migration) save(slice int, timestamp int64) error {
+	if m.config.Checkpoint == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoint.Timestamps[slice] = timestamp
+	data, err := json.Marshal(m.checkpoint)
+	if err != nil {
+		return fmt.Errorf("Failed to encode migration checkpoint: %s", err)
+	}
+	// write then rename so a crash never leaves a truncated checkpoint behind
+	tmp := m.config.Checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write migration checkpoint: %s", err)
+	}
+	if err := os.Rename(tmp, m.config.Checkpoint); err != nil {
+		return fmt.Errorf("Failed to write migration checkpoint: %s", err)
+	}
+	return nil
+}
@@ -2,8 +2,15 @@ package elasticsearch
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 	"go.uber.org/zap"
 	elastic "gopkg.in/olivere/elastic.v6"
@@ -11,84 +18,503 @@ import (
 
 // ReadService will proxy Prometheus queries to Elasticsearch
 type ReadService struct {
-	client *elastic.Client
-	config *ReadConfig
-	logger *zap.Logger
+	client  *elastic.Client
+	config  *ReadConfig
+	logger  *zap.Logger
+	cache   *readCache
+	indices map[string]*indexResolver
+	rollups []*rollupLevel
+	sem     chan struct{}
 }
 
 // ReadConfig configures the ReadService
 type ReadConfig struct {
 	Alias   string
+	Daily   bool
 	MaxDocs int
+	// IndexRefresh is how long discovered index time bounds are cached, zero
+	// disables index pruning and every index of the alias is searched
+	IndexRefresh time.Duration
+	// Concurrency limits the number of searches executed in parallel
+	Concurrency int
+	// SplitInterval splits long queries into day aligned sub-searches of this
+	// length which are executed in parallel, zero disables splitting
+	SplitInterval time.Duration
+	// MaxSeries limits the number of series returned per query, zero is unlimited
+	MaxSeries int
+	// MaxSamples limits the number of samples returned per query, zero is unlimited
+	MaxSamples int
+	// MaxRange limits the time range of a query, zero is unlimited
+	MaxRange time.Duration
+	// Timeout bounds the execution of a query, zero is unlimited
+	Timeout time.Duration
+	// TerminateAfter caps the documents each shard collects per search, zero is
+	// unlimited
+	TerminateAfter int
+	// Routes send matching series to other aliases than Alias, which reads
+	// fan out to
+	Routes []*RoutingRule
+	// RoutingKey is the shard routing samples were written with, see
+	// WriteConfig
+	RoutingKey string
+	// DocValues reads samples from doc values rather than _source, which
+	// indices created with the optimized profile do not store
+	DocValues bool
+	// Storage is the storage mode samples were written with, see WriteConfig
+	Storage string
+	// Resolutions lists the rollup resolutions maintained by DownsampleService
+	Resolutions []time.Duration
+	// CacheMaxBytes bounds the in-memory query result cache, zero disables caching
+	CacheMaxBytes int64
+	// CacheDir optionally persists cached results to disk
+	CacheDir string
+	// CacheStep is the size of the aligned time ranges results are cached by
+	CacheStep time.Duration
+	// CacheMinAge is how old data must be before it is considered immutable
+	CacheMinAge time.Duration
 }
 
 // NewReadService will create a new ReadService
-func NewReadService(logger *zap.Logger, client *elastic.Client, config *ReadConfig) *ReadService {
+func NewReadService(logger *zap.Logger, client *elastic.Client, config *ReadConfig) (*ReadService, error) {
+	if config.Concurrency <= 0 {
+		return nil, fmt.Errorf("invalid read concurrency %d", config.Concurrency)
+	}
 	svc := &ReadService{
 		client: client,
 		config: config,
 		logger: logger,
+		sem:    make(chan struct{}, config.Concurrency),
 	}
-	// TODO: add stats
-	return svc
-}
-
-// Read will perform Elasticsearch query
-func (svc *ReadService) Read(ctx context.Context, req []*prompb.Query) ([]*prompb.QueryResult, error) {
-	results := make([]*prompb.QueryResult, 0, len(req))
-	for _, q := range req {
-		resp, err := svc.buildCommand(q).Do(ctx)
+	if config.Storage == "" {
+		config.Storage = StorageIndex
+	}
+	if err := ValidateStorage(config.Storage); err != nil {
+		return nil, err
+	}
+	svc.indices = map[string]*indexResolver{
+		config.Alias: newIndexResolver(client, config.Alias, config.Daily, config.IndexRefresh, rollupPatterns(config.Alias, config.Resolutions)),
+	}
+	for _, rule := range config.Routes {
+		svc.indices[rule.Alias] = newIndexResolver(client, rule.Alias, config.Daily, config.IndexRefresh, nil)
+	}
+	for _, resolver := range svc.indices {
+		resolver.dataStream = IsDataStream(config.Storage)
+	}
+	for _, res := range config.Resolutions {
+		svc.rollups = append(svc.rollups, newRollupLevel(client, config.Alias, res, config.IndexRefresh))
+	}
+	// coarsest resolution first
+	sort.Slice(svc.rollups, func(i, j int) bool { return svc.rollups[i].resolution > svc.rollups[j].resolution })
+	if config.CacheMaxBytes > 0 {
+		if config.CacheStep <= 0 {
+			return nil, fmt.Errorf("invalid cache step %s", config.CacheStep)
+		}
+		cache, err := newReadCache(logger, config.CacheMaxBytes, config.CacheDir)
 		if err != nil {
 			return nil, err
 		}
-		svc.logger.Debug("Query returned results", zap.Int64("hits", resp.Hits.TotalHits))
-		ts, err := svc.createTimeseries(resp.Hits)
+		svc.cache = cache
+	}
+	return svc, nil
+}
+
+// Read will perform Elasticsearch query.  ranges holds the range_ms read hint
+// of each query, the range of its range vector selector, which may be nil when
+// unknown.  Errors are returned as *ReadError.  When some documents could not
+// be decoded the remaining results are returned together with an
+// ErrPartialData error.
+func (svc *ReadService) Read(ctx context.Context, req []*prompb.Query, ranges []int64) ([]*prompb.QueryResult, error) {
+	results, err := svc.read(ctx, req, ranges)
+	if err != nil {
+		if e, ok := err.(*ReadError); ok {
+			readErrorsTotal.WithLabelValues(e.Kind.String()).Inc()
+		}
+	}
+	return results, err
+}
+
+// read executes all queries concurrently, the number of searches in flight
+// being bounded by Concurrency
+func (svc *ReadService) read(ctx context.Context, req []*prompb.Query, ranges []int64) ([]*prompb.QueryResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*prompb.QueryResult, len(req))
+	errs := make([]error, len(req))
+	var wg sync.WaitGroup
+	for i, q := range req {
+		wg.Add(1)
+		var rangeMs int64
+		if i < len(ranges) {
+			rangeMs = ranges[i]
+		}
+		go func(i int, q *prompb.Query) {
+			defer wg.Done()
+			ts, err := svc.query(ctx, q, rangeMs)
+			if err != nil && !isPartialData(err) {
+				// no point finishing the other queries
+				cancel()
+			}
+			results[i] = &prompb.QueryResult{Timeseries: ts}
+			errs[i] = err
+		}(i, q)
+	}
+	wg.Wait()
+	return results, firstError(errs)
+}
+
+// query splits a query into sub-ranges, served from the cache where possible
+// and otherwise searched in parallel, and merges the resulting series
+func (svc *ReadService) query(ctx context.Context, q *prompb.Query, rangeMs int64) ([]*prompb.TimeSeries, error) {
+	if svc.config.MaxRange > 0 {
+		maxRange := int64(svc.config.MaxRange / time.Millisecond)
+		if q.EndTimestampMs-q.StartTimestampMs > maxRange {
+			return nil, limitExceeded("range", "query time range exceeds the limit of %s", svc.config.MaxRange)
+		}
+	}
+	if svc.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, svc.config.Timeout)
+		defer cancel()
+	}
+
+	segments, err := svc.segments(ctx, q, rangeMs)
+	if err != nil {
+		return nil, err
+	}
+	// cached blocks may extend past their segment, so results are trimmed to
+	// the segment they were fetched for
+	var ranges, bounds []timeRange
+	for _, seg := range segments {
+		for _, r := range svc.splitRange(seg) {
+			ranges = append(ranges, r)
+			bounds = append(bounds, seg)
+		}
+	}
+	var fn string
+	if q.Hints != nil {
+		fn = q.Hints.Func
+	}
+
+	series := make([][]*prompb.TimeSeries, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r timeRange) {
+			defer wg.Done()
+			series[i], errs[i] = svc.fetchRange(ctx, q.Matchers, r, fn)
+		}(i, r)
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil && !isPartialData(err) {
+		if svc.config.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+			return nil, limitExceeded("timeout", "query timed out after %s", svc.config.Timeout)
+		}
+		return nil, err
+	}
+
+	merged := newSeriesMerger()
+	for i, s := range series {
+		merged.add(s, bounds[i].start, bounds[i].end)
+	}
+	ret := merged.series()
+	if err := svc.checkLimits(ret); err != nil {
+		return nil, err
+	}
+	return ret, firstError(errs)
+}
+
+// checkLimits enforces MaxSeries and MaxSamples on the series of a query
+func (svc *ReadService) checkLimits(series []*prompb.TimeSeries) error {
+	if svc.config.MaxSeries > 0 && len(series) > svc.config.MaxSeries {
+		return limitExceeded("series", "query returned more than the limit of %d series", svc.config.MaxSeries)
+	}
+	if svc.config.MaxSamples > 0 {
+		var samples int
+		for _, ts := range series {
+			samples += len(ts.Samples)
+		}
+		if samples > svc.config.MaxSamples {
+			return limitExceeded("samples", "query returned more than the limit of %d samples", svc.config.MaxSamples)
+		}
+	}
+	return nil
+}
+
+// firstError returns the first error which is not ErrPartialData, or failing
+// that the first ErrPartialData error
+func firstError(errs []error) error {
+	var partial error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if !isPartialData(err) {
+			return err
+		}
+		if partial == nil {
+			partial = err
+		}
+	}
+	return partial
+}
+
+// rawPatterns match the raw sample indices of every alias
+func (svc *ReadService) rawPatterns() []string {
+	var patterns []string
+	for _, rule := range svc.config.Routes {
+		patterns = append(patterns, svc.indices[rule.Alias].patterns()...)
+	}
+	return append(patterns, svc.indices[svc.config.Alias].patterns()...)
+}
+
+// newSearch returns a search of sample documents in indices
+func (svc *ReadService) newSearch(indices ...string) *elastic.SearchService {
+	search := svc.client.Search().Index(indices...)
+	// document types are gone from the Elasticsearch versions with data streams
+	if !IsDataStream(svc.config.Storage) {
+		search = search.Type(sampleType)
+	}
+	return search
+}
+
+// aliases returns the aliases which may hold series selected by matchers
+func (svc *ReadService) aliases(matchers []*prompb.LabelMatcher) []string {
+	return routeAliases(svc.config.Routes, svc.config.Alias, matchers)
+}
+
+// resolve returns the indices to search for a time range, across the aliases
+// which may hold series selected by matchers
+func (svc *ReadService) resolve(ctx context.Context, matchers []*prompb.LabelMatcher, r timeRange) ([]string, error) {
+	if level := svc.rollupLevel(r.resolution); level != nil {
+		return level.indices.indices(ctx, r.start, r.end)
+	}
+	var indices []string
+	for _, alias := range svc.aliases(matchers) {
+		selected, err := svc.indices[alias].indices(ctx, r.start, r.end)
 		if err != nil {
 			return nil, err
 		}
-		results = append(results, &prompb.QueryResult{Timeseries: ts})
+		indices = append(indices, selected...)
+	}
+	return indices, nil
+}
+
+// search fetches the series selected by matchers within a time range, from the
+// rollups when the range has a resolution, in which case fn selects the
+// aggregate returned.  The returned bool reports whether every matching
+// document was retrieved, which is not the case when the search was capped by
+// MaxDocs.
+func (svc *ReadService) search(ctx context.Context, matchers []*prompb.LabelMatcher, r timeRange, fn string) ([]*prompb.TimeSeries, bool, error) {
+	indices, err := svc.resolve(ctx, matchers, r)
+	if err != nil {
+		return nil, false, storageError(err)
+	}
+	if len(indices) == 0 {
+		return nil, true, nil
+	}
+	source, filters, err := svc.buildCommand(matchers, r.start, r.end)
+	if err != nil {
+		return nil, false, err
+	}
+	if svc.config.DocValues && r.resolution == 0 {
+		source = source.FetchSource(false).DocvalueFieldsWithFormat(sampleDocvalueFields...)
+	}
+	select {
+	case svc.sem <- struct{}{}:
+		defer func() { <-svc.sem }()
+	case <-ctx.Done():
+		return nil, false, storageError(ctx.Err())
+	}
+	resp, err := svc.doSearch(ctx, indices, source, queryRouting(svc.config.RoutingKey, matchers))
+	if err != nil {
+		return nil, false, storageError(err)
+	}
+	if resp.TimedOut {
+		return nil, false, limitExceeded("timeout", "query timed out after %s", svc.config.Timeout)
+	}
+	if resp.TerminatedEarly {
+		return nil, false, limitExceeded("terminate_after", "query matched more than the limit of %d documents per shard", svc.config.TerminateAfter)
+	}
+	if svc.config.MaxSamples > 0 && len(filters) == 0 && resp.Hits.TotalHits > int64(svc.config.MaxSamples) {
+		// fail before decoding documents which would be discarded anyway
+		return nil, false, limitExceeded("samples", "query returned more than the limit of %d samples", svc.config.MaxSamples)
+	}
+	svc.logger.Debug("Query returned results", zap.Strings("indices", indices), zap.Int64("hits", resp.Hits.TotalHits))
+	complete := resp.Hits.TotalHits <= int64(len(resp.Hits.Hits))
+	if r.resolution > 0 {
+		ts, err := svc.createRollupTimeseries(resp.Hits, filters, fn)
+		return ts, complete, err
+	}
+	ts, err := svc.createTimeseries(resp.Hits, filters)
+	return ts, complete, err
+}
+
+func (svc *ReadService) buildCommand(matchers []*prompb.LabelMatcher, start, end int64) (*elastic.SearchSource, []*labelFilter, error) {
+	query, filters, err := svc.buildQuery(matchers, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// an exact total tells whether every matching document was returned
+	source := elastic.NewSearchSource().
+		Query(query).
+		Size(svc.config.MaxDocs).
+		TrackTotalHits(true).
+		Sort("timestamp", true)
+	if svc.config.Timeout > 0 {
+		source = source.TimeoutInMillis(int(svc.config.Timeout / time.Millisecond))
+	}
+	if svc.config.TerminateAfter > 0 {
+		source = source.TerminateAfter(svc.config.TerminateAfter)
+	}
+	return source, filters, nil
+}
+
+// doSearch runs a search of sample documents in indices, as newSearch does,
+// keeping whether a shard stopped collecting at the terminate_after limit
+func (svc *ReadService) doSearch(ctx context.Context, indices []string, source *elastic.SearchSource, routing string) (*searchResult, error) {
+	body, err := source.Source()
+	if err != nil {
+		return nil, err
+	}
+	escaped := make([]string, len(indices))
+	for i, index := range indices {
+		escaped[i] = url.PathEscape(index)
+	}
+	path := "/" + strings.Join(escaped, ",")
+	if !IsDataStream(svc.config.Storage) {
+		path += "/" + sampleType
+	}
+	params := url.Values{"ignore_unavailable": []string{"true"}}
+	if routing != "" {
+		params.Set("routing", routing)
+	}
+	res, err := svc.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   path + "/_search",
+		Params: params,
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
 	}
-	return results, nil
+	return decodeSearchResult(res.Body)
 }
 
-func (svc *ReadService) buildCommand(q *prompb.Query) *elastic.SearchService {
+// labelFilter is a regex matcher that cannot be expressed as a Lucene regexp
+// and is therefore evaluated against each returned series instead
+type labelFilter struct {
+	name   model.LabelName
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (f *labelFilter) matches(m model.Metric) bool {
+	// a missing label matches as an empty value, as in Prometheus
+	return f.re.MatchString(string(m[f.name])) != f.negate
+}
+
+// buildQuery translates Prometheus label matchers and a time range into an
+// Elasticsearch query.  A zero start or end leaves that side of the range open.
+// As in Prometheus, a label that is absent from a series is treated as having
+// an empty value.  Regex matchers which cannot be translated to Lucene syntax
+// are returned as filters to apply to the resulting series.
+func (svc *ReadService) buildQuery(matchers []*prompb.LabelMatcher, start, end int64) (*elastic.BoolQuery, []*labelFilter, error) {
+	var filters []*labelFilter
 	query := elastic.NewBoolQuery()
-	for _, m := range q.Matchers {
+	for _, m := range matchers {
+		field := labelPrefix + m.Name
+		exists := elastic.NewExistsQuery(field)
 		switch m.Type {
 		case prompb.LabelMatcher_EQ:
-			query = query.Filter(elastic.NewTermQuery("label."+m.Name, m.Value))
+			if m.Value == "" {
+				query = query.MustNot(exists)
+			} else {
+				query = query.Filter(elastic.NewTermQuery(field, m.Value))
+			}
 		case prompb.LabelMatcher_NEQ:
-			query = query.MustNot(elastic.NewTermQuery("label."+m.Name, m.Value))
-		case prompb.LabelMatcher_RE:
-			query = query.Filter(elastic.NewRegexpQuery("label."+m.Name, m.Value))
-		case prompb.LabelMatcher_NRE:
-			query = query.MustNot(elastic.NewRegexpQuery("label."+m.Name, m.Value))
+			if m.Value == "" {
+				query = query.Filter(exists)
+			} else {
+				query = query.MustNot(elastic.NewTermQuery(field, m.Value))
+			}
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			if m.Type == prompb.LabelMatcher_RE && m.Value == ".*" {
+				// matches every series, including those without the label
+				continue
+			}
+			re, err := compileMatcherRegexp(m.Value)
+			if err != nil {
+				return nil, nil, badRequest(fmt.Errorf("invalid regular expression %q: %s", m.Value, err))
+			}
+			negate := m.Type == prompb.LabelMatcher_NRE
+			matchesEmpty := re.MatchString("")
+			if matchesEmpty == negate {
+				// only series carrying the label can match
+				query = query.Filter(exists)
+			}
+			lucene, err := translateRegexp(m.Value)
+			if err != nil {
+				svc.logger.Debug("Filtering regex matcher after query", zap.String("regex", m.Value), zap.Error(err))
+				filters = append(filters, &labelFilter{
+					name:   model.LabelName(m.Name),
+					re:     re,
+					negate: negate,
+				})
+				continue
+			}
+			regexpQuery := elastic.NewRegexpQuery(field, lucene)
+			switch {
+			case negate:
+				query = query.MustNot(regexpQuery)
+			case matchesEmpty:
+				query = query.Filter(elastic.NewBoolQuery().
+					Should(regexpQuery, elastic.NewBoolQuery().MustNot(exists)).
+					MinimumNumberShouldMatch(1))
+			default:
+				query = query.Filter(regexpQuery)
+			}
 		default:
-			svc.logger.Panic("unknown match", zap.String("type", m.Type.String()))
+			return nil, nil, badRequest(fmt.Errorf("unknown matcher type %s", m.Type.String()))
 		}
 	}
 
-	query = query.Filter(elastic.NewRangeQuery("timestamp").Gte(q.StartTimestampMs).Lte(q.EndTimestampMs))
-
-	return svc.client.Search().
-		Index(svc.config.Alias+"-*").
-		Type(sampleType).
-		Query(query).
-		Size(svc.config.MaxDocs).
-		Sort("timestamp", true)
+	if start > 0 || end > 0 {
+		timeRange := elastic.NewRangeQuery("timestamp")
+		if start > 0 {
+			timeRange = timeRange.Gte(start)
+		}
+		if end > 0 {
+			timeRange = timeRange.Lte(end)
+		}
+		query = query.Filter(timeRange)
+	}
+	return query, filters, nil
 }
 
-func (svc *ReadService) createTimeseries(results *elastic.SearchHits) ([]*prompb.TimeSeries, error) {
+// createTimeseries groups search hits into series.  Documents which cannot be
+// decoded are skipped and reported through an ErrPartialData error alongside
+// the series built from the remaining documents.
+func (svc *ReadService) createTimeseries(results *elastic.SearchHits, filters []*labelFilter) ([]*prompb.TimeSeries, error) {
+	var skipped int
 	tsMap := make(map[string]*prompb.TimeSeries)
 	for _, r := range results.Hits {
-		var s prometheusSample
-		if err := json.Unmarshal([]byte(*r.Source), &s); err != nil {
-			svc.logger.Fatal("Failed to unmarshal sample", zap.Error(err))
+		s, err := decodeSample(r, svc.config.DocValues)
+		if err != nil {
+			svc.logger.Warn("Failed to decode sample", zap.String("index", r.Index), zap.String("id", r.Id), zap.Error(err))
+			skipped++
+			continue
 		}
 		fingerprint := s.Labels.Fingerprint().String()
 
 		ts, ok := tsMap[fingerprint]
 		if !ok {
+			if !matchesFilters(s.Labels, filters) {
+				tsMap[fingerprint] = nil
+				continue
+			}
 			labels := make([]*prompb.Label, 0, len(s.Labels))
 			for k, v := range s.Labels {
 				labels = append(labels, &prompb.Label{
@@ -101,6 +527,9 @@ func (svc *ReadService) createTimeseries(results *elastic.SearchHits) ([]*prompb
 			}
 			tsMap[fingerprint] = ts
 		}
+		if ts == nil {
+			continue
+		}
 		ts.Samples = append(ts.Samples, prompb.Sample{
 			Value:     s.Value,
 			Timestamp: s.Timestamp,
@@ -109,7 +538,24 @@ func (svc *ReadService) createTimeseries(results *elastic.SearchHits) ([]*prompb
 	ret := make([]*prompb.TimeSeries, 0, len(tsMap))
 
 	for _, s := range tsMap {
-		ret = append(ret, s)
+		if s != nil {
+			ret = append(ret, s)
+		}
+	}
+	if skipped > 0 {
+		return ret, &ReadError{
+			Kind: ErrPartialData,
+			Err:  fmt.Errorf("%d of %d documents could not be decoded", skipped, len(results.Hits)),
+		}
 	}
 	return ret, nil
 }
+
+func matchesFilters(m model.Metric, filters []*labelFilter) bool {
+	for _, f := range filters {
+		if !f.matches(m) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package elasticsearch
+
+import (
+	"errors"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// luceneReserved are the characters that carry meaning in Lucene regular
+// expressions (with all optional operators enabled) and must be escaped
+const luceneReserved = `.?+*|{}[]()"\#@&<>~`
+
+var errUntranslatable = errors.New("regular expression cannot be expressed in Lucene syntax")
+
+// translateRegexp converts a Prometheus (RE2) regular expression into the
+// Lucene dialect understood by Elasticsearch regexp queries.  Both dialects
+// are implicitly anchored for label matching so anchors at the edges of the
+// expression are dropped.  Expressions relying on features Lucene lacks, such
+// as word boundaries or anchors mid-expression, return errUntranslatable and
+// must be evaluated in Go instead.
+func translateRegexp(expr string) (string, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	re = re.Simplify()
+	re = stripEdgeAnchors(re)
+
+	var b strings.Builder
+	if err := writeLucene(&b, re); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// compileMatcherRegexp compiles a matcher value with the full anchoring
+// Prometheus applies to label regexes
+func compileMatcherRegexp(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func stripEdgeAnchors(re *syntax.Regexp) *syntax.Regexp {
+	if re.Op != syntax.OpConcat {
+		if isAnchor(re.Op) {
+			return &syntax.Regexp{Op: syntax.OpEmptyMatch}
+		}
+		return re
+	}
+	subs := re.Sub
+	for len(subs) > 0 && isAnchor(subs[0].Op) {
+		subs = subs[1:]
+	}
+	for len(subs) > 0 && isAnchor(subs[len(subs)-1].Op) {
+		subs = subs[:len(subs)-1]
+	}
+	stripped := *re
+	stripped.Sub = subs
+	return &stripped
+}
+
+func isAnchor(op syntax.Op) bool {
+	switch op {
+	case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+		return true
+	}
+	return false
+}
+
+func writeLucene(b *strings.Builder, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		// The empty language operator never matches
+		b.WriteString("#")
+	case syntax.OpEmptyMatch:
+		b.WriteString(`""`)
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			writeLiteral(b, r, re.Flags&syntax.FoldCase != 0)
+		}
+	case syntax.OpCharClass:
+		writeCharClass(b, re.Rune)
+	case syntax.OpAnyCharNotNL:
+		b.WriteString("[^\n]")
+	case syntax.OpAnyChar:
+		b.WriteString(".")
+	case syntax.OpCapture:
+		b.WriteString("(")
+		if err := writeLucene(b, re.Sub[0]); err != nil {
+			return err
+		}
+		b.WriteString(")")
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		b.WriteString("(")
+		if err := writeLucene(b, re.Sub[0]); err != nil {
+			return err
+		}
+		b.WriteString(")")
+		switch re.Op {
+		case syntax.OpStar:
+			b.WriteString("*")
+		case syntax.OpPlus:
+			b.WriteString("+")
+		case syntax.OpQuest:
+			b.WriteString("?")
+		default:
+			b.WriteString("{" + strconv.Itoa(re.Min) + ",")
+			if re.Max >= 0 {
+				b.WriteString(strconv.Itoa(re.Max))
+			}
+			b.WriteString("}")
+		}
+	case syntax.OpConcat:
+		if len(re.Sub) == 0 {
+			b.WriteString(`""`)
+		}
+		for _, sub := range re.Sub {
+			if err := writeLucene(b, sub); err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		b.WriteString("(")
+		for i, sub := range re.Sub {
+			if i > 0 {
+				b.WriteString("|")
+			}
+			if err := writeLucene(b, sub); err != nil {
+				return err
+			}
+		}
+		b.WriteString(")")
+	default:
+		// Anchors mid-expression and word boundaries have no Lucene equivalent
+		return errUntranslatable
+	}
+	return nil
+}
+
+func writeLiteral(b *strings.Builder, r rune, foldCase bool) {
+	if foldCase && unicode.ToUpper(r) != unicode.ToLower(r) {
+		b.WriteString("[")
+		writeClassRune(b, unicode.ToLower(r))
+		writeClassRune(b, unicode.ToUpper(r))
+		b.WriteString("]")
+		return
+	}
+	if strings.ContainsRune(luceneReserved, r) {
+		b.WriteRune('\\')
+	}
+	b.WriteRune(r)
+}
+
+// writeCharClass writes the rune ranges of a character class.  Negated classes
+// have already been expanded into positive ranges by the RE2 parser.
+func writeCharClass(b *strings.Builder, ranges []rune) {
+	if len(ranges) == 0 {
+		b.WriteString("#")
+		return
+	}
+	b.WriteString("[")
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		writeClassRune(b, lo)
+		if hi != lo {
+			b.WriteString("-")
+			writeClassRune(b, hi)
+		}
+	}
+	b.WriteString("]")
+}
+
+func writeClassRune(b *strings.Builder, r rune) {
+	if strings.ContainsRune(`\[]^-"`, r) {
+		b.WriteRune('\\')
+	}
+	b.WriteRune(r)
+}
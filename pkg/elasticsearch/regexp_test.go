@@ -0,0 +1,115 @@
+package elasticsearch
+
+import "testing"
+
+func TestTranslateRegexp(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		// anchors at the edges are implied by both dialects
+		{`foo`, `foo`},
+		{`^foo$`, `foo`},
+		{`\Afoo\z`, `foo`},
+		{`^(foo|bar)$`, `((foo|bar))`},
+		// case folding
+		{`(?i)foo`, `[fF][oO][oO]`},
+		{`(?i)Ab1-`, `[aA][bB]1-`},
+		{`(?i)[a-c]`, `[A-Ca-c]`},
+		// character classes and escapes
+		{`[a-c]x`, `[a-c]x`},
+		{`[^a]`, "[\x00-`b-\U0010ffff]"},
+		{`[\-\]^]`, `[\-\]-\^]`},
+		{`[[:alpha:]]`, `[A-Za-z]`},
+		{`\d+`, `([0-9])+`},
+		{`x\s`, "x[\t-\n\f-\r ]"},
+		{`\.\*\+\?`, `\.\*\+\?`},
+		{`\(\)\[\]\{\}\|\\`, `\(\)\[\]\{\}\|\\`},
+		{`"x"`, `\"x\"`},
+		{`\x{263a}`, "☺"},
+		{`a.*`, "a([^\n])*"},
+		{`(?s)a.`, `a.`},
+		// repeats
+		{`a?`, `(a)?`},
+		{`(a)*`, `((a))*`},
+		{`a{3}`, `aaa`},
+		{`a{2,3}`, `aa(a)?`},
+		{`a{2,}`, `a(a)+`},
+		{`(ab){1,2}`, `(ab)((ab))?`},
+		// Lucene reserved characters are literals in RE2
+		{`a@b&c<d>e~f#g`, `a\@b\&c\<d\>e\~f\#g`},
+		{`[@#]`, `[#@]`},
+		// the empty string
+		{``, `""`},
+		{`^$`, `""`},
+		{`a|`, `(a|"")`},
+		{`(|a)`, `((""|a))`},
+	}
+	for _, test := range tests {
+		got, err := translateRegexp(test.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.expr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestTranslateRegexpUntranslatable(t *testing.T) {
+	for _, expr := range []string{
+		`a\bb`,
+		`\Bx`,
+		`a^b`,
+		`a$b`,
+		`(a|^b)`,
+	} {
+		if _, err := translateRegexp(expr); err != errUntranslatable {
+			t.Errorf("%s: got error %v, want %v", expr, err, errUntranslatable)
+		}
+		// the fallback evaluates the expression in Go instead
+		if _, err := compileMatcherRegexp(expr); err != nil {
+			t.Errorf("%s: unexpected error compiling fallback: %s", expr, err)
+		}
+	}
+}
+
+func TestTranslateRegexpInvalid(t *testing.T) {
+	for _, expr := range []string{`(`, `a{2,1}`, `[z-a]`, `a**`} {
+		if _, err := translateRegexp(expr); err == nil || err == errUntranslatable {
+			t.Errorf("%s: got error %v, want a parse error", expr, err)
+		}
+	}
+}
+
+func TestCompileMatcherRegexp(t *testing.T) {
+	tests := []struct {
+		expr         string
+		value        string
+		matches      bool
+		matchesEmpty bool
+	}{
+		{`foo`, `foo`, true, false},
+		{`foo`, `foobar`, false, false},
+		{`foo|bar`, `bar`, true, false},
+		{`.*`, `anything`, true, true},
+		{`.+`, ``, false, false},
+		{``, ``, true, true},
+		{`a|`, ``, true, true},
+		{`a*`, `aaa`, true, true},
+		{`a\bb`, `a b`, false, false},
+	}
+	for _, test := range tests {
+		re, err := compileMatcherRegexp(test.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.expr, err)
+			continue
+		}
+		if got := re.MatchString(test.value); got != test.matches {
+			t.Errorf("%s: matching %q got %t, want %t", test.expr, test.value, got, test.matches)
+		}
+		if got := re.MatchString(""); got != test.matchesEmpty {
+			t.Errorf("%s: matching the empty string got %t, want %t", test.expr, got, test.matchesEmpty)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// retentionInterval is the period between retention runs
+const retentionInterval = time.Hour
+
+// RetentionService periodically deletes the indices of an alias whose newest
+// sample is older than the retention period
+type RetentionService struct {
+	ctx    context.Context
+	client *elastic.Client
+	config *RetentionConfig
+	logger *zap.Logger
+}
+
+// RetentionConfig is used to configure RetentionService
+type RetentionConfig struct {
+	Alias string
+	// Resolutions lists the rollups of the alias, which are left out of the
+	// search for expired indices.  Rollup indices of any resolution are kept
+	// regardless, as they may exist while downsampling is disabled.
+	Resolutions []time.Duration
+	Retention   time.Duration
+}
+
+// NewRetentionService starts deleting expired indices in the background
+func NewRetentionService(ctx context.Context, logger *zap.Logger, client *elastic.Client, config *RetentionConfig) *RetentionService {
+	svc := &RetentionService{
+		ctx:    ctx,
+		client: client,
+		config: config,
+		logger: logger,
+	}
+	go svc.run()
+	return svc
+}
+
+func (svc *RetentionService) run() {
+	for {
+		if err := svc.enforce(); err != nil {
+			svc.logger.Error("Failed to enforce retention", zap.String("alias", svc.config.Alias), zap.Error(err))
+		}
+		select {
+		case <-time.After(retentionInterval):
+		case <-svc.ctx.Done():
+			svc.logger.Info("Retention service exiting")
+			return
+		}
+	}
+}
+
+// enforce deletes the expired indices, never those the alias points at nor
+// rollup indices
+func (svc *RetentionService) enforce() error {
+	aliases, err := svc.client.Aliases().Index(svc.config.Alias).Do(svc.ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return fmt.Errorf("Failed to resolve alias %s: %s", svc.config.Alias, err)
+	}
+	write := make(map[string]bool)
+	if aliases != nil {
+		for _, index := range aliases.IndicesByAlias(svc.config.Alias) {
+			write[index] = true
+		}
+	}
+
+	resp, err := svc.client.Search().
+		Index(rawIndexPatterns(svc.config.Alias, svc.config.Resolutions)...).
+		IgnoreUnavailable(true).
+		Size(0).
+		Aggregation("indices", elastic.NewTermsAggregation().
+			Field("_index").
+			Size(10000).
+			SubAggregation("max", elastic.NewMaxAggregation().Field("timestamp"))).
+		Do(svc.ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to aggregate index bounds: %s", err)
+	}
+	cutoff := time.Now().Add(-svc.config.Retention).UnixNano() / int64(time.Millisecond)
+	var expired []string
+	if indices, ok := resp.Aggregations.Terms("indices"); ok {
+		for _, b := range indices.Buckets {
+			name := fmt.Sprint(b.Key)
+			max, ok := b.Aggregations.Max("max")
+			if !ok || max.Value == nil || write[name] || isRollupIndex(svc.config.Alias, name) || int64(*max.Value) >= cutoff {
+				continue
+			}
+			expired = append(expired, name)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	if _, err := svc.client.DeleteIndex(expired...).Do(svc.ctx); err != nil {
+		return fmt.Errorf("Failed to delete expired indices: %s", err)
+	}
+	svc.logger.Info("Deleted expired indices", zap.Strings("indices", expired))
+	return nil
+}
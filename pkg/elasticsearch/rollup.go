@@ -0,0 +1,289 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// rollupLevel resolves the rollup indices of one resolution and the time range
+// they cover.  Coverage is discovered with min/max aggregations and cached for
+// refresh.
+type rollupLevel struct {
+	client     *elastic.Client
+	alias      string
+	resolution time.Duration
+	refresh    time.Duration
+	indices    *indexResolver
+
+	mu       sync.Mutex
+	fetched  time.Time
+	min, max int64
+}
+
+func newRollupLevel(client *elastic.Client, alias string, resolution, refresh time.Duration) *rollupLevel {
+	return &rollupLevel{
+		client:     client,
+		alias:      rollupAlias(alias, resolution),
+		resolution: resolution,
+		refresh:    refresh,
+		indices:    newIndexResolver(client, rollupAlias(alias, resolution), true, refresh, nil),
+	}
+}
+
+// coverage returns the range of the buckets rolled up so far, as the start of
+// the first bucket and the end (exclusive) of the last.  An empty range means
+// no rollups exist yet.
+func (l *rollupLevel) coverage(ctx context.Context) (int64, int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.refresh > 0 && time.Since(l.fetched) <= l.refresh {
+		return l.min, l.max, nil
+	}
+	resp, err := l.client.Search().
+		Index(l.alias+"-*").
+		IgnoreUnavailable(true).
+		Size(0).
+		Aggregation("min", elastic.NewMinAggregation().Field("timestamp")).
+		Aggregation("max", elastic.NewMaxAggregation().Field("timestamp")).
+		Do(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to aggregate rollup coverage: %s", err)
+	}
+	l.min, l.max = 0, 0
+	min, minOk := resp.Aggregations.Min("min")
+	max, maxOk := resp.Aggregations.Max("max")
+	if minOk && maxOk && min.Value != nil && max.Value != nil {
+		l.min = int64(*min.Value)
+		l.max = int64(*max.Value) + int64(l.resolution/time.Millisecond)
+	}
+	l.fetched = time.Now()
+	return l.min, l.max, nil
+}
+
+// rollupLevel returns the level holding rollups at resolution, if any
+func (svc *ReadService) rollupLevel(resolution time.Duration) *rollupLevel {
+	if resolution <= 0 {
+		return nil
+	}
+	for _, l := range svc.rollups {
+		if l.resolution == resolution {
+			return l
+		}
+	}
+	return nil
+}
+
+// lookbackMs is the default Prometheus lookback delta, the window in which
+// plain selectors find the sample of each step
+const lookbackMs = int64(5 * time.Minute / time.Millisecond)
+
+// segments divides a query into a raw head, a middle read from the coarsest
+// rollups coarser than neither the query step nor the window of its function,
+// and a raw tail.  The window is rangeMs for range functions and the lookback
+// delta for plain selectors.  Queries without a step hint, with a range
+// function but no range hint, whose function rollups cannot answer, which no
+// rollups cover, or which may select series routed to aliases other than the
+// main alias, which are not rolled up, are read from raw samples only.
+func (svc *ReadService) segments(ctx context.Context, q *prompb.Query, rangeMs int64) ([]timeRange, error) {
+	whole := []timeRange{{start: q.StartTimestampMs, end: q.EndTimestampMs}}
+	if q.Hints == nil || q.Hints.StepMs <= 0 {
+		return whole, nil
+	}
+	if _, ok := rollupField(q.Hints.Func); !ok {
+		return whole, nil
+	}
+	if counterFunc(q.Hints.Func) && !selectsCounters(q.Matchers) {
+		return whole, nil
+	}
+	if aliases := svc.aliases(q.Matchers); len(aliases) != 1 || aliases[0] != svc.config.Alias {
+		return whole, nil
+	}
+	// each window must hold a bucket for the function to see
+	window := rangeMs
+	if q.Hints.Func == "" {
+		window = lookbackMs
+	}
+	if window <= 0 {
+		return whole, nil
+	}
+	var level *rollupLevel
+	for _, l := range svc.rollups {
+		res := int64(l.resolution / time.Millisecond)
+		if res <= q.Hints.StepMs && res <= window {
+			level = l
+			break
+		}
+	}
+	if level == nil {
+		return whole, nil
+	}
+	min, max, err := level.coverage(ctx)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	// only whole buckets within the query range are read from rollups
+	step := int64(level.resolution / time.Millisecond)
+	from := (q.StartTimestampMs + step - 1) / step * step
+	to := (q.EndTimestampMs + 1) / step * step
+	if from < min {
+		from = min
+	}
+	if to > max {
+		to = max
+	}
+	if from >= to {
+		return whole, nil
+	}
+
+	var segments []timeRange
+	if from > q.StartTimestampMs {
+		segments = append(segments, timeRange{start: q.StartTimestampMs, end: from - 1})
+	}
+	segments = append(segments, timeRange{start: from, end: to - 1, resolution: level.resolution})
+	if to <= q.EndTimestampMs {
+		segments = append(segments, timeRange{start: to, end: q.EndTimestampMs})
+	}
+	return segments, nil
+}
+
+// rollupField names the rollup aggregate answering a function, reporting false
+// for functions which would give other results over one sample per bucket than
+// over the raw samples, such as count_over_time, sum_over_time or
+// avg_over_time.
+func rollupField(fn string) (string, bool) {
+	switch fn {
+	case "min_over_time":
+		return "min", true
+	case "max_over_time":
+		return "max", true
+	case "", "last_over_time", "rate", "increase", "resets":
+		return "last", true
+	}
+	return "", false
+}
+
+// counterFunc reports whether fn is only answered correctly from rollups of
+// counters, which keep the raw samples bounding each bucket and its resets
+func counterFunc(fn string) bool {
+	switch fn {
+	case "rate", "increase", "resets":
+		return true
+	}
+	return false
+}
+
+// selectsCounters reports whether matchers select a single metric rolled up as
+// a counter
+func selectsCounters(matchers []*prompb.LabelMatcher) bool {
+	for _, m := range matchers {
+		if m.Name == model.MetricNameLabel && m.Type == prompb.LabelMatcher_EQ {
+			return isCounter(model.Metric{model.MetricNameLabel: model.LabelValue(m.Value)})
+		}
+	}
+	return false
+}
+
+// createRollupTimeseries converts rollup documents into series holding one
+// sample per bucket, at the timestamp of the last raw sample in the bucket.
+// Counters are returned as the raw samples bounding each bucket and each
+// reset within it, so rate and increase over them remain correct.
+func (svc *ReadService) createRollupTimeseries(results *elastic.SearchHits, filters []*labelFilter, fn string) ([]*prompb.TimeSeries, error) {
+	field, ok := rollupField(fn)
+	if !ok {
+		field = "last"
+	}
+	var skipped int
+	tsMap := make(map[string]*prompb.TimeSeries)
+	for _, r := range results.Hits {
+		var s rollupSample
+		if r.Source == nil {
+			skipped++
+			continue
+		}
+		if err := json.Unmarshal([]byte(*r.Source), &s); err != nil {
+			svc.logger.Warn("Failed to unmarshal rollup", zap.String("index", r.Index), zap.String("id", r.Id), zap.Error(err))
+			skipped++
+			continue
+		}
+
+		ts, ok := tsMap[s.Fingerprint]
+		if !ok {
+			if !matchesFilters(s.Labels, filters) {
+				tsMap[s.Fingerprint] = nil
+				continue
+			}
+			labels := make([]*prompb.Label, 0, len(s.Labels))
+			for k, v := range s.Labels {
+				labels = append(labels, &prompb.Label{
+					Name:  string(k),
+					Value: string(v),
+				})
+			}
+			ts = &prompb.TimeSeries{
+				Labels: labels,
+			}
+			tsMap[s.Fingerprint] = ts
+		}
+		if ts == nil {
+			continue
+		}
+		if s.Counter && field == "last" {
+			ts.Samples = append(ts.Samples, counterSamples(&s)...)
+			continue
+		}
+		var value float64
+		switch field {
+		case "min":
+			value = s.Min
+		case "max":
+			value = s.Max
+		default:
+			value = s.Last
+		}
+		ts.Samples = append(ts.Samples, prompb.Sample{
+			Value:     value,
+			Timestamp: s.LastTimestamp,
+		})
+	}
+	ret := make([]*prompb.TimeSeries, 0, len(tsMap))
+
+	for _, s := range tsMap {
+		if s != nil {
+			ret = append(ret, s)
+		}
+	}
+	if skipped > 0 {
+		return ret, &ReadError{
+			Kind: ErrPartialData,
+			Err:  fmt.Errorf("%d of %d rollups could not be decoded", skipped, len(results.Hits)),
+		}
+	}
+	return ret, nil
+}
+
+// counterSamples returns the raw samples kept by a counter rollup in timestamp
+// order: the first and last of the bucket and those either side of each reset
+func counterSamples(r *rollupSample) []prompb.Sample {
+	points := make([]rollupPoint, 0, len(r.Resets)+2)
+	points = append(points, rollupPoint{Timestamp: r.FirstTimestamp, Value: r.First})
+	points = append(points, r.Resets...)
+	points = append(points, rollupPoint{Timestamp: r.LastTimestamp, Value: r.Last})
+
+	samples := make([]prompb.Sample, 0, len(points))
+	for _, p := range points {
+		if n := len(samples); n > 0 && p.Timestamp <= samples[n-1].Timestamp {
+			continue
+		}
+		samples = append(samples, prompb.Sample{Value: p.Value, Timestamp: p.Timestamp})
+	}
+	return samples
+}
@@ -0,0 +1,93 @@
+package elasticsearch
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestSegments(t *testing.T) {
+	const (
+		minute = int64(time.Minute / time.Millisecond)
+		hour   = int64(time.Hour / time.Millisecond)
+		day    = 24 * hour
+	)
+	level := func(resolution time.Duration) *rollupLevel {
+		// covered up to the end of the first day, cached for the test
+		return &rollupLevel{resolution: resolution, refresh: time.Hour, fetched: time.Now(), max: day}
+	}
+	svc := &ReadService{
+		config:  &ReadConfig{Alias: "prometheus"},
+		rollups: []*rollupLevel{level(time.Hour), level(5 * time.Minute)},
+	}
+	counter := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "http_requests_total"}}
+	gauge := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "temperature"}}
+	raw := func(start, end int64) []timeRange {
+		return []timeRange{{start: start, end: end}}
+	}
+
+	tests := []struct {
+		name     string
+		matchers []*prompb.LabelMatcher
+		hints    *prompb.ReadHints
+		rangeMs  int64
+		want     []timeRange
+	}{
+		{"no hints", gauge, nil, 0, raw(0, 2*day)},
+		{"selector", gauge, &prompb.ReadHints{StepMs: hour}, 0, []timeRange{
+			{start: 0, end: day - 1, resolution: 5 * time.Minute},
+			{start: day, end: 2 * day},
+		}},
+		{"step below resolutions", gauge, &prompb.ReadHints{StepMs: minute}, 0, raw(0, 2*day)},
+		{"max over range", gauge, &prompb.ReadHints{StepMs: hour, Func: "max_over_time"}, 2 * hour, []timeRange{
+			{start: 0, end: day - 1, resolution: time.Hour},
+			{start: day, end: 2 * day},
+		}},
+		{"range below step", gauge, &prompb.ReadHints{StepMs: hour, Func: "min_over_time"}, 10 * minute, []timeRange{
+			{start: 0, end: day - 1, resolution: 5 * time.Minute},
+			{start: day, end: 2 * day},
+		}},
+		{"range below resolutions", gauge, &prompb.ReadHints{StepMs: hour, Func: "max_over_time"}, minute, raw(0, 2*day)},
+		{"range unknown", gauge, &prompb.ReadHints{StepMs: hour, Func: "max_over_time"}, 0, raw(0, 2*day)},
+		{"count over range", gauge, &prompb.ReadHints{StepMs: hour, Func: "count_over_time"}, hour, raw(0, 2*day)},
+		{"sum over range", gauge, &prompb.ReadHints{StepMs: hour, Func: "sum_over_time"}, hour, raw(0, 2*day)},
+		{"avg over range", gauge, &prompb.ReadHints{StepMs: hour, Func: "avg_over_time"}, hour, raw(0, 2*day)},
+		{"rate of counter", counter, &prompb.ReadHints{StepMs: hour, Func: "rate"}, hour, []timeRange{
+			{start: 0, end: day - 1, resolution: time.Hour},
+			{start: day, end: 2 * day},
+		}},
+		{"rate of gauge", gauge, &prompb.ReadHints{StepMs: hour, Func: "rate"}, hour, raw(0, 2*day)},
+	}
+	for _, test := range tests {
+		q := &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 2 * day, Matchers: test.matchers, Hints: test.hints}
+		got, err := svc.segments(context.Background(), q, test.rangeMs)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIsRollupIndex(t *testing.T) {
+	for index, want := range map[string]bool{
+		"prometheus-5m-2019-06-01":  true,
+		"prometheus-1h-2019-06-01":  true,
+		"prometheus-90s-2019-06-01": true,
+		"prometheus-2019-06-01":     false,
+		"prometheus-000002":         false,
+		"prometheus-1":              false,
+		"prometheus-5m-000002":      false,
+		"other-5m-2019-06-01":       false,
+		"prometheus-other-5m-2019":  false,
+	} {
+		if got := isRollupIndex("prometheus", index); got != want {
+			t.Errorf("%s: got %t, want %t", index, got, want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// RoutingRule sends the series matching all of its label regexps to a
+// separate alias, with its own index template, rollover and retention
+type RoutingRule struct {
+	// Match maps label names to regexps the label value must fully match
+	Match     map[string]string `json:"match"`
+	Alias     string            `json:"alias"`
+	Shards    int               `json:"shards"`
+	Replicas  int               `json:"replicas"`
+	MaxAge    string            `json:"max_age"`
+	MaxDocs   int64             `json:"max_docs"`
+	MaxSize   string            `json:"max_size"`
+	Retention string            `json:"retention"`
+
+	matchers  map[model.LabelName]*regexp.Regexp
+	retention time.Duration
+}
+
+// LoadRoutingRules reads a JSON array of routing rules from path.  Rule aliases
+// must not share the index prefix of alias, or of each other, as index
+// patterns would overlap.
+func LoadRoutingRules(path, alias string) ([]*RoutingRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read routing rules: %s", err)
+	}
+	var rules []*RoutingRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Failed to decode routing rules: %s", err)
+	}
+	aliases := []string{alias}
+	for i, rule := range rules {
+		if rule.Alias == "" || len(rule.Match) == 0 {
+			return nil, fmt.Errorf("routing rule %d needs an alias and at least one matcher", i)
+		}
+		for _, a := range aliases {
+			if strings.HasPrefix(rule.Alias+"-", a+"-") || strings.HasPrefix(a+"-", rule.Alias+"-") {
+				return nil, fmt.Errorf("routing rule alias %s overlaps the indices of %s", rule.Alias, a)
+			}
+		}
+		aliases = append(aliases, rule.Alias)
+		if rule.Retention != "" {
+			if rule.retention, err = time.ParseDuration(rule.Retention); err != nil {
+				return nil, fmt.Errorf("routing rule %d: %s", i, err)
+			}
+		}
+		rule.matchers = make(map[model.LabelName]*regexp.Regexp, len(rule.Match))
+		for name, expr := range rule.Match {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %d: %s", i, err)
+			}
+			rule.matchers[model.LabelName(name)] = re
+		}
+	}
+	return rules, nil
+}
+
+// RetentionPeriod is how long the indices of the rule are kept, zero forever
+func (rule *RoutingRule) RetentionPeriod() time.Duration {
+	return rule.retention
+}
+
+// matches reports whether a series is routed by the rule
+func (rule *RoutingRule) matches(m model.Metric) bool {
+	for name, re := range rule.matchers {
+		if !re.MatchString(string(m[name])) {
+			return false
+		}
+	}
+	return true
+}
+
+// routeAlias returns the alias of the first rule matching a series, or the
+// default alias when none does
+func routeAlias(rules []*RoutingRule, alias string, m model.Metric) string {
+	for _, rule := range rules {
+		if rule.matches(m) {
+			return rule.Alias
+		}
+	}
+	return alias
+}
+
+// routeMatch is how far the equality matchers of a query decide a rule
+type routeMatch int
+
+const (
+	routeNever routeMatch = iota
+	routeMaybe
+	routeAlways
+)
+
+// classify decides from the equality matchers of a query whether the series
+// it selects are all, some or none matched by the rule
+func (rule *RoutingRule) classify(matchers []*prompb.LabelMatcher) routeMatch {
+	match := routeAlways
+	for name, re := range rule.matchers {
+		pinned := false
+		for _, m := range matchers {
+			if m.Type != prompb.LabelMatcher_EQ || model.LabelName(m.Name) != name {
+				continue
+			}
+			if !re.MatchString(m.Value) {
+				return routeNever
+			}
+			pinned = true
+		}
+		if !pinned {
+			match = routeMaybe
+		}
+	}
+	return match
+}
+
+// routeAliases returns the aliases which may hold series selected by a query,
+// in rule order followed by the default alias
+func routeAliases(rules []*RoutingRule, alias string, matchers []*prompb.LabelMatcher) []string {
+	var aliases []string
+	for _, rule := range rules {
+		switch rule.classify(matchers) {
+		case routeAlways:
+			// every selected series not taken by an earlier rule is routed
+			// here, so none reach later rules or the default alias
+			return append(aliases, rule.Alias)
+		case routeMaybe:
+			aliases = append(aliases, rule.Alias)
+		}
+	}
+	return append(aliases, alias)
+}
+
+// routingFingerprint routes documents by series fingerprint, and routingLabel
+// prefixes the name of a label to route documents by
+const (
+	routingFingerprint = "fingerprint"
+	routingLabel       = "label:"
+)
+
+// ValidateRoutingKey checks a shard routing key is empty, "fingerprint" or
+// "label:<name>"
+func ValidateRoutingKey(key string) error {
+	if key == "" || key == routingFingerprint {
+		return nil
+	}
+	if strings.HasPrefix(key, routingLabel) && model.LabelName(strings.TrimPrefix(key, routingLabel)).IsValid() {
+		return nil
+	}
+	return fmt.Errorf("invalid routing key %q, must be fingerprint or label:<name>", key)
+}
+
+// documentRouting returns the shard routing of the documents of a series, empty
+// to leave them routed by id
+func documentRouting(key string, m model.Metric, fingerprint string) string {
+	switch {
+	case key == routingFingerprint:
+		return fingerprint
+	case strings.HasPrefix(key, routingLabel):
+		return string(m[model.LabelName(strings.TrimPrefix(key, routingLabel))])
+	}
+	return ""
+}
+
+// queryRouting returns the shard routing of the documents selected by a query,
+// empty when they may be on any shard.  Only label routing can be derived from
+// matchers, as fingerprints depend on every label of a series.
+func queryRouting(key string, matchers []*prompb.LabelMatcher) string {
+	if !strings.HasPrefix(key, routingLabel) {
+		return ""
+	}
+	name := strings.TrimPrefix(key, routingLabel)
+	for _, m := range matchers {
+		if m.Type == prompb.LabelMatcher_EQ && m.Name == name && m.Value != "" {
+			return m.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// seriesTrackerInterval is the period between pruning idle series and saving
+// the tracker state
+const seriesTrackerInterval = time.Minute
+
+// seriesTracker counts the active series of each tenant, those written within
+// the idle timeout, and refuses new series past the limit.  Its state is
+// optionally saved to a file so limits survive restarts.
+type seriesTracker struct {
+	limit  int
+	idle   time.Duration
+	path   string
+	logger *zap.Logger
+
+	mu sync.Mutex
+	// tenants maps tenant to series fingerprint to the unix time the series
+	// was last written
+	tenants map[string]map[string]int64
+}
+
+func newSeriesTracker(logger *zap.Logger, limit int, idle time.Duration, path string) (*seriesTracker, error) {
+	t := &seriesTracker{
+		limit:   limit,
+		idle:    idle,
+		path:    path,
+		logger:  logger,
+		tenants: make(map[string]map[string]int64),
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// accept records a write of a series by tenant, reporting false for a new
+// series when the tenant is at its limit
+func (t *seriesTracker) accept(tenant, fingerprint string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	series, ok := t.tenants[tenant]
+	if !ok {
+		series = make(map[string]int64)
+		t.tenants[tenant] = series
+	}
+	if _, ok := series[fingerprint]; !ok {
+		if len(series) >= t.limit {
+			return false
+		}
+		activeSeries.WithLabelValues(tenant).Set(float64(len(series) + 1))
+	}
+	series[fingerprint] = now.Unix()
+	return true
+}
+
+// run periodically prunes idle series and saves the state until ctx is done
+func (t *seriesTracker) run(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(seriesTrackerInterval):
+		case <-ctx.Done():
+			t.save()
+			return
+		}
+		t.prune(time.Now())
+		t.save()
+	}
+}
+
+func (t *seriesTracker) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := now.Add(-t.idle).Unix()
+	for tenant, series := range t.tenants {
+		for fingerprint, seen := range series {
+			if seen < cutoff {
+				delete(series, fingerprint)
+			}
+		}
+		activeSeries.WithLabelValues(tenant).Set(float64(len(series)))
+		if len(series) == 0 {
+			delete(t.tenants, tenant)
+			activeSeries.DeleteLabelValues(tenant)
+		}
+	}
+}
+
+func (t *seriesTracker) load() error {
+	if t.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read series state: %s", err)
+	}
+	if err := json.Unmarshal(data, &t.tenants); err != nil {
+		return fmt.Errorf("Failed to decode series state: %s", err)
+	}
+	t.prune(time.Now())
+	return nil
+}
+
+func (t *seriesTracker) save() {
+	if t.path == "" {
+		return
+	}
+	t.mu.Lock()
+	data, err := json.Marshal(t.tenants)
+	t.mu.Unlock()
+	if err != nil {
+		t.logger.Warn("Failed to encode series state", zap.Error(err))
+		return
+	}
+	// write then rename so a crash never leaves a truncated state behind
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		t.logger.Warn("Failed to write series state", zap.Error(err))
+		return
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		t.logger.Warn("Failed to write series state", zap.Error(err))
+	}
+}
@@ -0,0 +1,112 @@
+package elasticsearch
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// timeRange is an inclusive range of millisecond timestamps
+type timeRange struct {
+	start, end int64
+	// cacheable ranges are immutable, step aligned blocks
+	cacheable bool
+	// resolution of the rollups to read, zero for raw samples
+	resolution time.Duration
+}
+
+// splitRange divides a range into the sub-ranges searched independently.
+// When caching is enabled the leading immutable part of the range is split
+// into CacheStep aligned blocks.  The remainder is split into SplitInterval
+// aligned ranges.
+func (svc *ReadService) splitRange(r timeRange) []timeRange {
+	var ranges []timeRange
+	start, end := r.start, r.end
+	from := start
+	if svc.cache != nil {
+		step := int64(svc.config.CacheStep / time.Millisecond)
+		nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+		immutableEnd := (nowMs - int64(svc.config.CacheMinAge/time.Millisecond)) / step * step
+		for block := from / step * step; block+step <= immutableEnd && block <= end; block += step {
+			ranges = append(ranges, timeRange{start: block, end: block + step - 1, cacheable: true, resolution: r.resolution})
+			from = block + step
+		}
+	}
+	interval := int64(svc.config.SplitInterval / time.Millisecond)
+	for from <= end {
+		to := end
+		if interval > 0 {
+			if next := (from/interval + 1) * interval; next <= end {
+				to = next - 1
+			}
+		}
+		ranges = append(ranges, timeRange{start: from, end: to, resolution: r.resolution})
+		from = to + 1
+	}
+	return ranges
+}
+
+func (svc *ReadService) fetchRange(ctx context.Context, matchers []*prompb.LabelMatcher, r timeRange, fn string) ([]*prompb.TimeSeries, error) {
+	if r.cacheable {
+		return svc.cachedRange(ctx, matchers, r, fn)
+	}
+	series, _, err := svc.search(ctx, matchers, r, fn)
+	return series, err
+}
+
+// seriesMerger combines series from several time ranges by fingerprint
+type seriesMerger struct {
+	byFingerprint map[model.Fingerprint]*prompb.TimeSeries
+	order         []model.Fingerprint
+}
+
+func newSeriesMerger() *seriesMerger {
+	return &seriesMerger{byFingerprint: make(map[model.Fingerprint]*prompb.TimeSeries)}
+}
+
+// add appends the samples of series falling within start and end.  Cached
+// series are never modified.
+func (m *seriesMerger) add(series []*prompb.TimeSeries, start, end int64) {
+	for _, ts := range series {
+		fp := labelsFingerprint(ts.Labels)
+		merged, ok := m.byFingerprint[fp]
+		if !ok {
+			merged = &prompb.TimeSeries{Labels: ts.Labels}
+			m.byFingerprint[fp] = merged
+			m.order = append(m.order, fp)
+		}
+		for _, s := range ts.Samples {
+			if s.Timestamp >= start && s.Timestamp <= end {
+				merged.Samples = append(merged.Samples, s)
+			}
+		}
+	}
+}
+
+// series returns the merged series with their samples in timestamp order
+func (m *seriesMerger) series() []*prompb.TimeSeries {
+	ret := make([]*prompb.TimeSeries, 0, len(m.order))
+	for _, fp := range m.order {
+		ts := m.byFingerprint[fp]
+		if len(ts.Samples) == 0 {
+			continue
+		}
+		samples := ts.Samples
+		if !sort.SliceIsSorted(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp }) {
+			sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+		}
+		ret = append(ret, ts)
+	}
+	return ret
+}
+
+func labelsFingerprint(labels []*prompb.Label) model.Fingerprint {
+	metric := make(model.Metric, len(labels))
+	for _, l := range labels {
+		metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return metric.Fingerprint()
+}
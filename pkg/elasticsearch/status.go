@@ -0,0 +1,154 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// statusLabelBatch is the most label names whose values are counted in one
+// search
+const statusLabelBatch = 50
+
+// TSDBStatus reports where series cardinality and storage are spent, modelled on
+// the Prometheus /api/v1/status/tsdb endpoint
+type TSDBStatus struct {
+	SeriesCountByMetricName    []StatusEntry `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName []StatusEntry `json:"labelValueCountByLabelName"`
+	SamplesByDay               []StatusEntry `json:"samplesByDay"`
+	Indices                    []IndexStatus `json:"indices"`
+}
+
+// StatusEntry is a single name/count pair of a TSDBStatus ranking
+type StatusEntry struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+}
+
+// IndexStatus describes the size of an individual Elasticsearch index
+type IndexStatus struct {
+	Name      string `json:"name"`
+	Docs      int64  `json:"docs"`
+	SizeBytes int64  `json:"sizeBytes"`
+}
+
+// TSDBStatus computes cardinality statistics for the configured alias using
+// aggregations.  Series and distinct label value counts are approximate as they
+// rely on Elasticsearch cardinality aggregations.  Rankings are limited to the
+// top limit entries.
+func (svc *ReadService) TSDBStatus(ctx context.Context, limit int) (*TSDBStatus, error) {
+	names, err := svc.LabelNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	search := svc.newSearch(svc.rawPatterns()...).
+		Size(0).
+		Aggregation("metrics", elastic.NewTermsAggregation().
+			Field(labelPrefix+"__name__").
+			Size(limit).
+			OrderByAggregation("series", false).
+			SubAggregation("series", elastic.NewCardinalityAggregation().Field("fingerprint"))).
+		Aggregation("days", elastic.NewDateHistogramAggregation().
+			Field("timestamp").
+			Interval("1d").
+			Format("yyyy-MM-dd").
+			MinDocCount(1))
+	resp, err := search.Do(ctx)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	status := &TSDBStatus{
+		SeriesCountByMetricName:    []StatusEntry{},
+		LabelValueCountByLabelName: []StatusEntry{},
+		SamplesByDay:               []StatusEntry{},
+		Indices:                    []IndexStatus{},
+	}
+	if metrics, ok := resp.Aggregations.Terms("metrics"); ok {
+		for _, b := range metrics.Buckets {
+			var count int64
+			if series, ok := b.Aggregations.Cardinality("series"); ok && series.Value != nil {
+				count = int64(*series.Value)
+			}
+			status.SeriesCountByMetricName = append(status.SeriesCountByMetricName, StatusEntry{
+				Name:  fmt.Sprint(b.Key),
+				Value: count,
+			})
+		}
+	}
+	if days, ok := resp.Aggregations.DateHistogram("days"); ok {
+		for _, b := range days.Buckets {
+			name := fmt.Sprint(b.Key)
+			if b.KeyAsString != nil {
+				name = *b.KeyAsString
+			}
+			status.SamplesByDay = append(status.SamplesByDay, StatusEntry{
+				Name:  name,
+				Value: b.DocCount,
+			})
+		}
+	}
+	// every label name is counted to rank them, in batches which keep each
+	// search small however many label names there are
+	for start := 0; start < len(names); start += statusLabelBatch {
+		end := start + statusLabelBatch
+		if end > len(names) {
+			end = len(names)
+		}
+		search := svc.newSearch(svc.rawPatterns()...).Size(0)
+		for i, name := range names[start:end] {
+			search = search.Aggregation(labelAggName(i), elastic.NewCardinalityAggregation().Field(labelPrefix+name))
+		}
+		resp, err := search.Do(ctx)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		for i, name := range names[start:end] {
+			if values, ok := resp.Aggregations.Cardinality(labelAggName(i)); ok && values.Value != nil {
+				status.LabelValueCountByLabelName = append(status.LabelValueCountByLabelName, StatusEntry{
+					Name:  name,
+					Value: int64(*values.Value),
+				})
+			}
+		}
+	}
+	sort.SliceStable(status.LabelValueCountByLabelName, func(i, j int) bool {
+		return status.LabelValueCountByLabelName[i].Value > status.LabelValueCountByLabelName[j].Value
+	})
+	if len(status.LabelValueCountByLabelName) > limit {
+		status.LabelValueCountByLabelName = status.LabelValueCountByLabelName[:limit]
+	}
+
+	pattern := svc.config.Alias + "-*"
+	if IsDataStream(svc.config.Storage) {
+		// expands to the backing indices of the data stream
+		pattern = svc.config.Alias
+	}
+	stats, err := svc.client.IndexStats(pattern).Metric("docs", "store").Do(ctx)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	for name, s := range stats.Indices {
+		index := IndexStatus{Name: name}
+		if s.Primaries != nil && s.Primaries.Docs != nil {
+			index.Docs = s.Primaries.Docs.Count
+		}
+		if s.Total != nil && s.Total.Store != nil {
+			index.SizeBytes = s.Total.Store.SizeInBytes
+		}
+		status.Indices = append(status.Indices, index)
+	}
+	sort.Slice(status.Indices, func(i, j int) bool {
+		return status.Indices[i].Name < status.Indices[j].Name
+	})
+	return status, nil
+}
+
+// labelAggName avoids using label names, which may clash with the other
+// aggregations, as aggregation names
+func labelAggName(i int) string {
+	return fmt.Sprintf("label_%d", i)
+}
@@ -0,0 +1,128 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// tsdsRecheck is how often the start of a time series data stream which does
+// not exist yet is looked up again
+const tsdsRecheck = time.Minute
+
+// tsdsTracker resolves the earliest timestamp each time series data stream
+// accepts.  Elasticsearch fails samples older than the start time of the
+// oldest backing index, which reaches back the look back time from the
+// creation of the data stream.
+type tsdsTracker struct {
+	ctx      context.Context
+	client   *elastic.Client
+	logger   *zap.Logger
+	lookBack time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*tsdsStream
+}
+
+type tsdsStream struct {
+	start   int64
+	known   bool
+	checked time.Time
+}
+
+func newTSDSTracker(ctx context.Context, logger *zap.Logger, client *elastic.Client, lookBack time.Duration) *tsdsTracker {
+	if lookBack <= 0 {
+		lookBack = defaultLookBack
+	}
+	return &tsdsTracker{
+		ctx:      ctx,
+		client:   client,
+		logger:   logger,
+		lookBack: lookBack,
+		streams:  make(map[string]*tsdsStream),
+	}
+}
+
+// start returns the earliest timestamp the data stream named alias accepts.
+// A data stream which does not exist yet is created by the samples being
+// written, reaching back the look back time from now.  When the data stream
+// cannot be looked up no samples are held back.
+func (t *tsdsTracker) start(alias string, now time.Time) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.streams[alias]
+	if !ok {
+		s = &tsdsStream{}
+		t.streams[alias] = s
+	}
+	if !s.known && now.Sub(s.checked) >= tsdsRecheck {
+		s.checked = now
+		start, exists, err := dataStreamStart(t.ctx, t.client, alias)
+		if err != nil {
+			t.logger.Warn("Failed to resolve data stream start", zap.String("alias", alias), zap.Error(err))
+			return math.MinInt64
+		}
+		s.start, s.known = start, exists
+	}
+	if s.known {
+		return s.start
+	}
+	return now.Add(-t.lookBack).UnixNano() / int64(time.Millisecond)
+}
+
+// dataStreamStart returns the start time of the oldest backing index of a time
+// series data stream, reporting false when the data stream does not exist
+func dataStreamStart(ctx context.Context, client *elastic.Client, name string) (int64, bool, error) {
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/_data_stream/" + url.PathEscape(name),
+	})
+	if elastic.IsNotFound(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var streams struct {
+		DataStreams []struct {
+			Indices []struct {
+				IndexName string `json:"index_name"`
+			} `json:"indices"`
+		} `json:"data_streams"`
+	}
+	if err := json.Unmarshal(res.Body, &streams); err != nil {
+		return 0, false, err
+	}
+	if len(streams.DataStreams) == 0 || len(streams.DataStreams[0].Indices) == 0 {
+		return 0, false, nil
+	}
+	index := streams.DataStreams[0].Indices[0].IndexName
+
+	res, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/" + url.PathEscape(index) + "/_settings/index.time_series.start_time",
+		Params: url.Values{"flat_settings": []string{"true"}},
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	var settings map[string]struct {
+		Settings map[string]string `json:"settings"`
+	}
+	if err := json.Unmarshal(res.Body, &settings); err != nil {
+		return 0, false, err
+	}
+	value := settings[index].Settings["index.time_series.start_time"]
+	start, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid start time %q of %s: %s", value, index, err)
+	}
+	return start.UnixNano() / int64(time.Millisecond), true, nil
+}
@@ -2,8 +2,13 @@ package elasticsearch
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,17 +18,110 @@ import (
 	elastic "gopkg.in/olivere/elastic.v6"
 )
 
+// staleNaN is the bit pattern of the NaN Prometheus writes as a staleness
+// marker, which must be told apart from ordinary NaN values
+const staleNaN uint64 = 0x7ff0000000000002
+
+func isStaleNaN(v float64) bool {
+	return math.Float64bits(v) == staleNaN
+}
+
 type prometheusSample struct {
-	Labels    model.Metric `json:"label"`
-	Value     float64      `json:"value"`
-	Timestamp int64        `json:"timestamp"`
+	Labels      model.Metric `json:"label"`
+	Fingerprint string       `json:"fingerprint"`
+	Value       float64      `json:"value"`
+	Timestamp   int64        `json:"timestamp"`
+	// dataStream adds the @timestamp field data streams require
+	dataStream bool
+}
+
+// sampleDoc is the document stored for a sample.  Elasticsearch doubles cannot
+// hold NaN or infinity, so staleness markers are stored as a flag and other
+// special values by name, both without a value.
+type sampleDoc struct {
+	Labels      model.Metric `json:"label"`
+	Fingerprint string       `json:"fingerprint"`
+	Value       *float64     `json:"value,omitempty"`
+	Stale       bool         `json:"stale,omitempty"`
+	Special     string       `json:"special,omitempty"`
+	Timestamp   int64        `json:"timestamp"`
+	// DataStreamTimestamp duplicates Timestamp in data streams
+	DataStreamTimestamp int64 `json:"@timestamp,omitempty"`
+}
+
+// special values are named as Prometheus formats them
+const (
+	specialNaN    = "NaN"
+	specialPosInf = "+Inf"
+	specialNegInf = "-Inf"
+)
+
+func (s prometheusSample) MarshalJSON() ([]byte, error) {
+	doc := sampleDoc{
+		Labels:      s.Labels,
+		Fingerprint: s.Fingerprint,
+		Timestamp:   s.Timestamp,
+	}
+	if s.dataStream {
+		doc.DataStreamTimestamp = s.Timestamp
+	}
+	switch {
+	case isStaleNaN(s.Value):
+		doc.Stale = true
+	case math.IsNaN(s.Value):
+		doc.Special = specialNaN
+	case math.IsInf(s.Value, 1):
+		doc.Special = specialPosInf
+	case math.IsInf(s.Value, -1):
+		doc.Special = specialNegInf
+	default:
+		doc.Value = &s.Value
+	}
+	return json.Marshal(doc)
+}
+
+func (s *prometheusSample) UnmarshalJSON(data []byte) error {
+	var doc sampleDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return s.fromDoc(&doc)
+}
+
+func (s *prometheusSample) fromDoc(doc *sampleDoc) error {
+	s.Labels = doc.Labels
+	s.Fingerprint = doc.Fingerprint
+	s.Timestamp = doc.Timestamp
+	switch {
+	case doc.Stale:
+		s.Value = math.Float64frombits(staleNaN)
+	case doc.Special == specialNaN:
+		s.Value = math.NaN()
+	case doc.Special == specialPosInf:
+		s.Value = math.Inf(1)
+	case doc.Special == specialNegInf:
+		s.Value = math.Inf(-1)
+	case doc.Special != "":
+		return fmt.Errorf("unknown special value %q", doc.Special)
+	case doc.Value != nil:
+		s.Value = *doc.Value
+	default:
+		return fmt.Errorf("sample has no value")
+	}
+	return nil
 }
 
 // WriteService will proxy Prometheus write requests to Elasticsearch
 type WriteService struct {
+	// failures counts the samples failed to be written since the last Flush,
+	// first for 64-bit alignment of atomic access
+	failures  int64
 	config    *WriteConfig
 	logger    *zap.Logger
 	processor *elastic.BulkProcessor
+	ha        *haTracker
+	series    *seriesTracker
+	tsds      *tsdsTracker
 }
 
 // WriteConfig is used to configure WriteService
@@ -35,14 +133,123 @@ type WriteConfig struct {
 	MaxSize int
 	Workers int
 	Stats   bool
+	// OpType is the bulk operation used to write samples, either "index" to
+	// overwrite a sample written before or "create" to keep the first write
+	OpType string
+	// HAClusterLabel and HAReplicaLabel identify Prometheus HA pairs, whose
+	// samples are only stored from one elected replica per cluster.  HA
+	// deduplication is disabled when HAClusterLabel is empty.
+	HAClusterLabel string
+	HAReplicaLabel string
+	// HAFailoverTimeout is how long the elected replica may stop writing
+	// before another replica is elected
+	HAFailoverTimeout time.Duration
+	// MaxSampleAge and MaxSampleFuture bound how far before and after now
+	// sample timestamps may be, samples outside are rejected.  Zero disables
+	// the bound.
+	MaxSampleAge    time.Duration
+	MaxSampleFuture time.Duration
+	// MaxSeriesPerTenant caps the active series of a tenant, those written
+	// within SeriesIdleTimeout, zero is unlimited
+	MaxSeriesPerTenant int
+	SeriesIdleTimeout  time.Duration
+	// SeriesStateFile persists the active series across restarts when set
+	SeriesStateFile string
+	// Routes send matching series to other aliases than Alias
+	Routes []*RoutingRule
+	// RoutingKey sets the shard routing of samples, either "fingerprint" or
+	// "label:<name>", empty leaves them routed by id
+	RoutingKey string
+	// Storage is the storage mode, StorageIndex when empty
+	Storage string
+	// LookBack is the look back time of the time series data streams of
+	// StorageTSDS, zero the Elasticsearch default.  Samples older than the
+	// start of the data stream, which Elasticsearch would fail, are rejected.
+	LookBack time.Duration
+}
+
+// BackfillConfig returns a copy of config for writing historical samples.  HA
+// deduplication, the series limit and the maximum sample age are left out, as
+// they are meant for live remote writes and would drop backfilled samples.
+func BackfillConfig(config *WriteConfig) *WriteConfig {
+	backfill := *config
+	backfill.HAClusterLabel = ""
+	backfill.HAReplicaLabel = ""
+	backfill.MaxSampleAge = 0
+	backfill.MaxSeriesPerTenant = 0
+	backfill.SeriesStateFile = ""
+	return &backfill
+}
+
+// Reasons samples are rejected by Write
+const (
+	rejectTooOld = "too_old"
+	rejectTooNew = "too_new"
+	// rejectSeriesLimit counts the samples of new series refused as the
+	// tenant is at its series limit
+	rejectSeriesLimit = "series_limit"
+)
+
+// RejectedError is returned by Write when some samples were rejected.  The
+// remaining samples have been accepted.
+type RejectedError struct {
+	Total    int
+	Rejected map[string]int
+}
+
+func (e *RejectedError) Error() string {
+	var n int
+	reasons := make([]string, 0, len(e.Rejected))
+	for reason, count := range e.Rejected {
+		n += count
+		reasons = append(reasons, fmt.Sprintf("%d %s", count, reason))
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("rejected %d of %d samples: %s", n, e.Total, strings.Join(reasons, ", "))
 }
 
 // NewWriteService creates and returns a new elasticsearch WriteService
 func NewWriteService(ctx context.Context, logger *zap.Logger, client *elastic.Client, config *WriteConfig) (*WriteService, error) {
+	if config.OpType != "index" && config.OpType != "create" {
+		return nil, fmt.Errorf("invalid op type %q, must be index or create", config.OpType)
+	}
+	if err := ValidateRoutingKey(config.RoutingKey); err != nil {
+		return nil, err
+	}
+	if config.Storage == "" {
+		config.Storage = StorageIndex
+	}
+	if err := ValidateStorage(config.Storage); err != nil {
+		return nil, err
+	}
+	if IsDataStream(config.Storage) {
+		// data streams only accept creates and route time series themselves
+		if config.Daily || config.RoutingKey != "" {
+			return nil, fmt.Errorf("daily indices and routing keys are not supported with %s storage", config.Storage)
+		}
+		config.OpType = "create"
+	}
 	svc := &WriteService{
 		config: config,
 		logger: logger,
 	}
+	if config.HAClusterLabel != "" {
+		if config.HAReplicaLabel == "" {
+			return nil, fmt.Errorf("HA replica label must be set with the cluster label")
+		}
+		svc.ha = newHATracker(config.HAFailoverTimeout)
+	}
+	if config.Storage == StorageTSDS {
+		svc.tsds = newTSDSTracker(ctx, logger, client, config.LookBack)
+	}
+	if config.MaxSeriesPerTenant > 0 {
+		series, err := newSeriesTracker(logger, config.MaxSeriesPerTenant, config.SeriesIdleTimeout, config.SeriesStateFile)
+		if err != nil {
+			return nil, err
+		}
+		svc.series = series
+		go series.run(ctx)
+	}
 	b, err := client.BulkProcessor().
 		Workers(config.Workers).                                   // # of workers
 		BulkActions(config.MaxDocs).                               // # of queued requests before committed
@@ -61,52 +268,154 @@ func NewWriteService(ctx context.Context, logger *zap.Logger, client *elastic.Cl
 	return svc, nil
 }
 
+// Flush commits the enqueued samples and reports the samples failed to be
+// written since the previous Flush
+func (svc *WriteService) Flush() error {
+	if err := svc.processor.Flush(); err != nil {
+		return err
+	}
+	if n := atomic.SwapInt64(&svc.failures, 0); n > 0 {
+		return fmt.Errorf("%d samples failed to be written", n)
+	}
+	return nil
+}
+
 // Close will close the underlying elasticsearch BulkProcessor
 func (svc *WriteService) Close() error {
 	return svc.processor.Close()
 }
 
-// Write will enqueue Prometheus sample data to be batch written to Elasticsearch
-func (svc *WriteService) Write(req []*prompb.TimeSeries) {
-	index := svc.config.Alias
+// Write will enqueue Prometheus sample data to be batch written to Elasticsearch.
+// Document ids are derived from the series and timestamp so that samples
+// resent by Prometheus are not stored twice.  Samples with timestamps outside
+// the acceptance window, or starting a series past the series limit of the
+// tenant, are rejected and reported by a *RejectedError.
+func (svc *WriteService) Write(tenant string, req []*prompb.TimeSeries) error {
+	now := time.Now()
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	var minTs, maxTs int64 = math.MinInt64, math.MaxInt64
+	if svc.config.MaxSampleAge > 0 {
+		minTs = nowMs - int64(svc.config.MaxSampleAge/time.Millisecond)
+	}
+	if svc.config.MaxSampleFuture > 0 {
+		maxTs = nowMs + int64(svc.config.MaxSampleFuture/time.Millisecond)
+	}
+	var total int
+	rejected := make(map[string]int)
 	for _, ts := range req {
 		metric := make(model.Metric, len(ts.Labels))
 		for _, l := range ts.Labels {
 			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
 		}
+		if !svc.acceptReplica(metric, now) {
+			haDroppedTotal.Add(float64(len(ts.Samples)))
+			continue
+		}
+		alias := routeAlias(svc.config.Routes, svc.config.Alias, metric)
+		index := alias
+		fingerprint := metric.Fingerprint().String()
+		routing := documentRouting(svc.config.RoutingKey, metric, fingerprint)
+		seriesMinTs := minTs
+		if svc.tsds != nil {
+			if start := svc.tsds.start(alias, now); start > seriesMinTs {
+				seriesMinTs = start
+			}
+		}
+		samples := make([]prompb.Sample, 0, len(ts.Samples))
 		for _, s := range ts.Samples {
-			v := float64(s.Value)
-			if math.IsNaN(v) || math.IsInf(v, 0) {
-				svc.logger.Debug(fmt.Sprintf("invalid value %+v, skipping sample %+v", v, s))
-				continue
+			total++
+			switch {
+			case s.Timestamp < seriesMinTs:
+				rejected[rejectTooOld]++
+			case s.Timestamp > maxTs:
+				rejected[rejectTooNew]++
+			default:
+				samples = append(samples, s)
 			}
+		}
+		// a series whose samples all fall outside the window is not active
+		if len(samples) == 0 {
+			continue
+		}
+		if svc.series != nil && !svc.series.accept(tenant, fingerprint, now) {
+			rejected[rejectSeriesLimit] += len(samples)
+			continue
+		}
+		for _, s := range samples {
+			v := float64(s.Value)
 			sample := prometheusSample{
-				metric,
-				v,
-				s.Timestamp,
+				Labels:      metric,
+				Fingerprint: fingerprint,
+				Value:       v,
+				Timestamp:   s.Timestamp,
+				dataStream:  IsDataStream(svc.config.Storage),
 			}
 			if svc.config.Daily {
-				index = svc.config.Alias + "-" + time.Unix(s.Timestamp/1000, 0).Format("2006-01-02")
+				index = dailyIndexName(alias, s.Timestamp)
 			}
 			r := elastic.
 				NewBulkIndexRequest().
 				Index(index).
-				Type(sampleType).
+				OpType(svc.config.OpType).
+				Routing(routing).
 				Doc(sample)
+			// time series data streams derive ids from the dimensions and
+			// timestamp, deduplicating resent samples themselves
+			if svc.config.Storage != StorageTSDS {
+				r = r.Id(fmt.Sprintf("%s-%d", fingerprint, s.Timestamp))
+			}
+			if !IsDataStream(svc.config.Storage) {
+				r = r.Type(sampleType)
+			}
 			svc.processor.Add(r)
 		}
 	}
+	if len(rejected) == 0 {
+		return nil
+	}
+	for reason, count := range rejected {
+		rejectedTotal.WithLabelValues(reason).Add(float64(count))
+	}
+	return &RejectedError{Total: total, Rejected: rejected}
+}
+
+// acceptReplica reports whether a series should be stored under HA
+// deduplication, removing the replica label so both replicas of a pair write
+// the same series
+func (svc *WriteService) acceptReplica(metric model.Metric, now time.Time) bool {
+	if svc.ha == nil {
+		return true
+	}
+	cluster, ok := metric[model.LabelName(svc.config.HAClusterLabel)]
+	if !ok {
+		return true
+	}
+	replicaLabel := model.LabelName(svc.config.HAReplicaLabel)
+	replica, ok := metric[replicaLabel]
+	if !ok {
+		return true
+	}
+	delete(metric, replicaLabel)
+	return svc.ha.accept(string(cluster), string(replica), now)
 }
 
 // after is invoked by bulk processor after every commit.
 // The err variable indicates success or failure.
 func (svc *WriteService) after(id int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
 	if err != nil {
+		atomic.AddInt64(&svc.failures, int64(len(requests)))
 		svc.logger.Error(err.Error())
 	} else {
 		for _, i := range response.Items {
-			if i["index"].Status != 201 {
-				svc.logger.Error(fmt.Sprintf("%+v", i["index"].Error))
+			for _, r := range i {
+				switch {
+				case r.Status == http.StatusConflict:
+					// already written by an earlier attempt
+					duplicatesTotal.Inc()
+				case r.Status >= 300:
+					atomic.AddInt64(&svc.failures, 1)
+					svc.logger.Error(fmt.Sprintf("%+v", r.Error))
+				}
 			}
 		}
 	}
@@ -0,0 +1,285 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"github.com/pwillie/prometheus-es-adapter/pkg/tsdb"
+	"go.uber.org/zap"
+)
+
+// Export formats
+const (
+	FormatOpenMetrics = "openmetrics"
+	FormatCSV         = "csv"
+	FormatParquet     = "parquet"
+	FormatTSDB        = "tsdb"
+)
+
+// staleNaN is the bit pattern of Prometheus staleness markers
+const staleNaN uint64 = 0x7ff0000000000002
+
+// Reader streams stored series, as elasticsearch.ReadService does
+type Reader interface {
+	Export(ctx context.Context, matchers []*prompb.LabelMatcher, start, end int64, fn func(*prompb.TimeSeries) error) error
+}
+
+// Config is used to configure Run
+type Config struct {
+	Matchers []*prompb.LabelMatcher
+	// Start and End bound the exported samples in milliseconds, inclusive
+	Start int64
+	End   int64
+	// Format is FormatOpenMetrics, FormatCSV, FormatParquet or FormatTSDB
+	Format string
+	// Output is the file written, "-" for stdout, or for FormatTSDB the
+	// directory blocks are created in
+	Output string
+	// BlockDuration is the time range covered by each TSDB block
+	BlockDuration time.Duration
+}
+
+// ValidateFormat checks format is one Run can write
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatOpenMetrics, FormatCSV, FormatParquet, FormatTSDB:
+		return nil
+	}
+	return fmt.Errorf("unsupported export format %q, must be %s, %s, %s or %s",
+		format, FormatOpenMetrics, FormatCSV, FormatParquet, FormatTSDB)
+}
+
+// Run writes the series selected by the matchers in the configured format.
+// When some documents could not be decoded the samples which could are still
+// written out completely before the ErrPartialData error is returned.
+func Run(ctx context.Context, logger *zap.Logger, r Reader, config *Config) error {
+	if err := ValidateFormat(config.Format); err != nil {
+		return err
+	}
+	if config.Format == FormatTSDB {
+		return exportBlocks(ctx, logger, r, config)
+	}
+
+	out := io.Writer(os.Stdout)
+	if config.Output != "-" {
+		f, err := os.Create(config.Output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	var enc encoder
+	switch config.Format {
+	case FormatCSV:
+		enc = newCSVEncoder(w)
+	case FormatParquet:
+		enc = newParquetEncoder(w)
+	default:
+		enc = &openMetricsEncoder{w: w}
+	}
+	var series, samples int
+	err := r.Export(ctx, config.Matchers, config.Start, config.End, func(ts *prompb.TimeSeries) error {
+		series++
+		samples += len(ts.Samples)
+		return enc.encode(ts)
+	})
+	if err != nil && !isPartialData(err) {
+		return err
+	}
+	if err := enc.close(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	logger.Info("Exported series", zap.Int("series", series), zap.Int("samples", samples))
+	return err
+}
+
+// exportBlocks writes a TSDB block per BlockDuration aligned window of the
+// time range, leaving out windows without samples
+func exportBlocks(ctx context.Context, logger *zap.Logger, r Reader, config *Config) error {
+	if err := os.MkdirAll(config.Output, 0755); err != nil {
+		return err
+	}
+	step := int64(config.BlockDuration / time.Millisecond)
+	if step <= 0 {
+		return fmt.Errorf("block duration must be positive")
+	}
+	var partial error
+	for from := config.Start / step * step; from <= config.End; from += step {
+		start, end := from, from+step-1
+		if start < config.Start {
+			start = config.Start
+		}
+		if end > config.End {
+			end = config.End
+		}
+		w, err := tsdb.NewBlockWriter(config.Output)
+		if err != nil {
+			return err
+		}
+		err = r.Export(ctx, config.Matchers, start, end, func(ts *prompb.TimeSeries) error {
+			return w.Add(ts.Labels, ts.Samples)
+		})
+		if err != nil && !isPartialData(err) {
+			w.Close()
+			return err
+		}
+		if err != nil && partial == nil {
+			partial = err
+		}
+		dir, err := w.Close()
+		if err != nil {
+			return err
+		}
+		if dir != "" {
+			logger.Info("Exported block", zap.String("block", dir), zap.Int64("start", start), zap.Int64("end", end))
+		}
+	}
+	return partial
+}
+
+// isPartialData reports whether err only signals that some documents could
+// not be decoded and were left out of the export
+func isPartialData(err error) bool {
+	e, ok := err.(*elasticsearch.ReadError)
+	return ok && e.Kind == elasticsearch.ErrPartialData
+}
+
+// encoder writes series in a file format.  Staleness markers only exist in
+// TSDB blocks, so are left out.
+type encoder interface {
+	encode(ts *prompb.TimeSeries) error
+	close() error
+}
+
+// openMetricsEncoder writes the OpenMetrics text format.  Series arrive in
+// metric name order, so the samples of each metric family are contiguous.
+// Series without a metric name cannot be written and are left out.
+type openMetricsEncoder struct {
+	w *bufio.Writer
+}
+
+func (e *openMetricsEncoder) encode(ts *prompb.TimeSeries) error {
+	series := formatSeries(ts.Labels)
+	if strings.HasPrefix(series, "{") {
+		return nil
+	}
+	for _, s := range ts.Samples {
+		if math.Float64bits(s.Value) == staleNaN {
+			continue
+		}
+		e.w.WriteString(series)
+		e.w.WriteByte(' ')
+		e.w.WriteString(formatValue(s.Value))
+		e.w.WriteByte(' ')
+		e.w.WriteString(strconv.FormatFloat(float64(s.Timestamp)/1000, 'f', -1, 64))
+		if _, err := e.w.WriteString("\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *openMetricsEncoder) close() error {
+	_, err := e.w.WriteString("# EOF\n")
+	return err
+}
+
+// csvEncoder writes a row per sample of the series, in the Prometheus
+// notation, the timestamp in milliseconds and the value
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer) *csvEncoder {
+	e := &csvEncoder{w: csv.NewWriter(w)}
+	e.w.Write([]string{"series", "timestamp", "value"})
+	return e
+}
+
+func (e *csvEncoder) encode(ts *prompb.TimeSeries) error {
+	series := formatSeries(ts.Labels)
+	for _, s := range ts.Samples {
+		if math.Float64bits(s.Value) == staleNaN {
+			continue
+		}
+		err := e.w.Write([]string{
+			series,
+			strconv.FormatInt(s.Timestamp, 10),
+			formatValue(s.Value),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *csvEncoder) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// formatSeries formats labels as name{label="value",...} with the labels in
+// name order
+func formatSeries(labels []*prompb.Label) string {
+	var name string
+	sorted := make([]*prompb.Label, 0, len(labels))
+	for _, l := range labels {
+		if l.Name == model.MetricNameLabel {
+			name = l.Value
+			continue
+		}
+		sorted = append(sorted, l)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var b strings.Builder
+	b.WriteString(name)
+	if len(sorted) == 0 && name != "" {
+		return b.String()
+	}
+	b.WriteByte('{')
+	for i, l := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// formatValue formats a sample value as Prometheus does
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
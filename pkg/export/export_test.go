@@ -0,0 +1,54 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"go.uber.org/zap"
+)
+
+// partialReader passes one series, then fails as an export which skipped
+// undecodable documents does
+type partialReader struct{}
+
+func (partialReader) Export(ctx context.Context, matchers []*prompb.LabelMatcher, start, end int64, fn func(*prompb.TimeSeries) error) error {
+	err := fn(&prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	return &elasticsearch.ReadError{Kind: elasticsearch.ErrPartialData, Err: errors.New("1 samples could not be decoded")}
+}
+
+func TestRunPartialData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out.txt")
+	err = Run(context.Background(), zap.NewNop(), partialReader{}, &Config{
+		Start:  0,
+		End:    2000,
+		Format: FormatOpenMetrics,
+		Output: output,
+	})
+	if !isPartialData(err) {
+		t.Fatalf("got %v, want the partial data error", err)
+	}
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "up 1 1\n# EOF\n"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
@@ -0,0 +1,324 @@
+package export
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// parquetRowGroupRows is the number of samples buffered into each row group
+const parquetRowGroupRows = 1 << 16
+
+const parquetMagic = "PAR1"
+
+// Parquet physical types, converted types and other enum values of the
+// parquet-format Thrift definitions
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetSnappy = 1
+
+	parquetDataPage = 0
+)
+
+// parquetColumns is the schema of Parquet exports, a row per sample as in CSV
+// exports
+var parquetColumns = []struct {
+	name      string
+	typ       int32
+	converted int32
+}{
+	{"series", parquetByteArray, parquetUTF8},
+	{"timestamp", parquetInt64, parquetTimestampMillis},
+	{"value", parquetDouble, -1},
+}
+
+// parquetEncoder writes a Parquet file of series, timestamp and value
+// columns, all required.  Samples are buffered into row groups which are
+// written out once full, each column as a single snappy compressed page of
+// plain encoded values, and the file metadata once the encoder is closed.
+// The format is written directly as no Parquet library is a dependency.
+type parquetEncoder struct {
+	w      *bufio.Writer
+	offset int64
+	err    error
+
+	series     []string
+	timestamps []int64
+	values     []float64
+
+	rowGroups []parquetRowGroup
+}
+
+type parquetRowGroup struct {
+	rows    int64
+	size    int64
+	columns []parquetColumnChunk
+}
+
+type parquetColumnChunk struct {
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+func newParquetEncoder(w *bufio.Writer) *parquetEncoder {
+	e := &parquetEncoder{w: w}
+	e.write([]byte(parquetMagic))
+	return e
+}
+
+func (e *parquetEncoder) write(b []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(b)
+	e.offset += int64(len(b))
+}
+
+func (e *parquetEncoder) encode(ts *prompb.TimeSeries) error {
+	series := formatSeries(ts.Labels)
+	for _, s := range ts.Samples {
+		if math.Float64bits(s.Value) == staleNaN {
+			continue
+		}
+		e.series = append(e.series, series)
+		e.timestamps = append(e.timestamps, s.Timestamp)
+		e.values = append(e.values, s.Value)
+		if len(e.series) >= parquetRowGroupRows {
+			e.flushRowGroup()
+		}
+	}
+	return e.err
+}
+
+// flushRowGroup writes out the buffered samples as a row group
+func (e *parquetEncoder) flushRowGroup() {
+	rows := len(e.series)
+	if rows == 0 {
+		return
+	}
+	var (
+		b  []byte
+		rg = parquetRowGroup{rows: int64(rows)}
+	)
+	for i := range parquetColumns {
+		b = b[:0]
+		switch i {
+		case 0:
+			for _, s := range e.series {
+				b = appendUint32(b, uint32(len(s)))
+				b = append(b, s...)
+			}
+		case 1:
+			for _, t := range e.timestamps {
+				b = appendUint64(b, uint64(t))
+			}
+		case 2:
+			for _, v := range e.values {
+				b = appendUint64(b, math.Float64bits(v))
+			}
+		}
+		page := snappy.Encode(nil, b)
+
+		var h thriftWriter
+		h.i32(1, parquetDataPage)
+		h.i32(2, int32(len(b)))
+		h.i32(3, int32(len(page)))
+		h.beginStruct(5)
+		h.i32(1, int32(rows))
+		h.i32(2, parquetPlain)
+		h.i32(3, parquetRLE)
+		h.i32(4, parquetRLE)
+		h.end()
+		h.end()
+
+		rg.columns = append(rg.columns, parquetColumnChunk{
+			offset:           e.offset,
+			uncompressedSize: int64(len(h.b) + len(b)),
+			compressedSize:   int64(len(h.b) + len(page)),
+		})
+		rg.size += int64(len(h.b) + len(b))
+		e.write(h.b)
+		e.write(page)
+	}
+	e.rowGroups = append(e.rowGroups, rg)
+	e.series = e.series[:0]
+	e.timestamps = e.timestamps[:0]
+	e.values = e.values[:0]
+}
+
+func (e *parquetEncoder) close() error {
+	e.flushRowGroup()
+
+	var (
+		m    thriftWriter
+		rows int64
+	)
+	for _, rg := range e.rowGroups {
+		rows += rg.rows
+	}
+	m.i32(1, 1)
+	m.list(2, thriftStruct, len(parquetColumns)+1)
+	m.beginElem()
+	m.binary(4, "schema")
+	m.i32(5, int32(len(parquetColumns)))
+	m.end()
+	for _, c := range parquetColumns {
+		m.beginElem()
+		m.i32(1, c.typ)
+		m.i32(3, parquetRequired)
+		m.binary(4, c.name)
+		if c.converted >= 0 {
+			m.i32(6, c.converted)
+		}
+		m.end()
+	}
+	m.i64(3, rows)
+	m.list(4, thriftStruct, len(e.rowGroups))
+	for _, rg := range e.rowGroups {
+		m.beginElem()
+		m.list(1, thriftStruct, len(rg.columns))
+		for i, c := range rg.columns {
+			m.beginElem()
+			m.i64(2, c.offset)
+			m.beginStruct(3)
+			m.i32(1, parquetColumns[i].typ)
+			m.list(2, thriftI32, 1)
+			m.varint(parquetPlain)
+			m.list(3, thriftBinary, 1)
+			m.string(parquetColumns[i].name)
+			m.i32(4, parquetSnappy)
+			m.i64(5, rg.rows)
+			m.i64(6, c.uncompressedSize)
+			m.i64(7, c.compressedSize)
+			m.i64(9, c.offset)
+			m.end()
+			m.end()
+		}
+		m.i64(2, rg.size)
+		m.i64(3, rg.rows)
+		m.end()
+	}
+	m.binary(6, "prometheus-es-adapter")
+	m.end()
+
+	e.write(m.b)
+	e.write(appendUint32(nil, uint32(len(m.b))))
+	e.write([]byte(parquetMagic))
+	return e.err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes a struct in the Thrift compact protocol, in which
+// Parquet metadata is written.  Fields must be written in id order.
+type thriftWriter struct {
+	b     []byte
+	last  int16
+	stack []int16
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	if delta := id - w.last; delta > 0 && delta <= 15 {
+		w.b = append(w.b, byte(delta)<<4|typ)
+	} else {
+		w.b = append(w.b, typ)
+		w.varint(int64(id))
+	}
+	w.last = id
+}
+
+// varint writes a zigzag encoded integer
+func (w *thriftWriter) varint(v int64) {
+	w.b = appendUvarint(w.b, uint64(v<<1^v>>63))
+}
+
+func (w *thriftWriter) string(s string) {
+	w.b = appendUvarint(w.b, uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *thriftWriter) binary(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.string(s)
+}
+
+// list starts a list field of n elements, which are written next
+func (w *thriftWriter) list(id int16, elem byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.b = append(w.b, byte(n)<<4|elem)
+	} else {
+		w.b = append(w.b, 0xf0|elem)
+		w.b = appendUvarint(w.b, uint64(n))
+	}
+}
+
+// beginStruct starts a struct field, ended by end
+func (w *thriftWriter) beginStruct(id int16) {
+	w.field(id, thriftStruct)
+	w.beginElem()
+}
+
+// beginElem starts a struct element of a list, ended by end
+func (w *thriftWriter) beginElem() {
+	w.stack = append(w.stack, w.last)
+	w.last = 0
+}
+
+// end ends the current struct
+func (w *thriftWriter) end() {
+	w.b = append(w.b, 0)
+	if n := len(w.stack); n > 0 {
+		w.last = w.stack[n-1]
+		w.stack = w.stack[:n-1]
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
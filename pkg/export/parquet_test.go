@@ -0,0 +1,192 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// thriftReader decodes the Thrift compact protocol into maps of field ids,
+// slices and scalars
+type thriftReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = true
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) byte() byte {
+	if len(r.b) == 0 {
+		r.err = true
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 3:
+		return r.byte()
+	case 4, 5, 6:
+		return r.varint()
+	case 8:
+		n := int(r.uvarint())
+		if n > len(r.b) {
+			r.err = true
+			return ""
+		}
+		s := string(r.b[:n])
+		r.b = r.b[n:]
+		return s
+	case 9:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		var l []interface{}
+		for i := 0; i < n && !r.err; i++ {
+			l = append(l, r.value(h&0xf))
+		}
+		return l
+	case 12:
+		s := make(map[int16]interface{})
+		var id int16
+		for !r.err {
+			h := r.byte()
+			if h == 0 {
+				break
+			}
+			if delta := int16(h >> 4); delta != 0 {
+				id += delta
+			} else {
+				id = int16(r.varint())
+			}
+			s[id] = r.value(h & 0xf)
+		}
+		return s
+	}
+	r.err = true
+	return nil
+}
+
+func TestParquetEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	enc := newParquetEncoder(w)
+	series := []*prompb.TimeSeries{
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: math.Float64frombits(staleNaN)}},
+		},
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "temperature"}},
+			Samples: []prompb.Sample{{Timestamp: 1500, Value: -2.5}, {Timestamp: 2500, Value: math.Inf(1)}},
+		},
+	}
+	for _, ts := range series {
+		if err := enc.encode(ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.close(); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	b := buf.Bytes()
+	if !bytes.HasPrefix(b, []byte("PAR1")) || !bytes.HasSuffix(b, []byte("PAR1")) {
+		t.Fatalf("missing magic")
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	r := &thriftReader{b: b[len(b)-8-n : len(b)-8]}
+	meta := r.value(12).(map[int16]interface{})
+	if r.err || len(r.b) != 0 {
+		t.Fatalf("invalid file metadata")
+	}
+	if meta[3] != int64(3) {
+		t.Fatalf("got %v rows, want 3", meta[3])
+	}
+	schema := meta[2].([]interface{})
+	if len(schema) != 4 || schema[0].(map[int16]interface{})[5] != int64(3) {
+		t.Fatalf("got schema %v", schema)
+	}
+	rowGroups := meta[4].([]interface{})
+	if len(rowGroups) != 1 {
+		t.Fatalf("got %d row groups", len(rowGroups))
+	}
+
+	var columns [][]byte
+	for i, c := range rowGroups[0].(map[int16]interface{})[1].([]interface{}) {
+		cm := c.(map[int16]interface{})[3].(map[int16]interface{})
+		if name := cm[3].([]interface{})[0]; name != parquetColumns[i].name {
+			t.Errorf("column %d: got %v", i, name)
+		}
+		r := &thriftReader{b: b[cm[9].(int64):]}
+		header := r.value(12).(map[int16]interface{})
+		if r.err || header[1] != int64(parquetDataPage) || header[5].(map[int16]interface{})[1] != int64(3) {
+			t.Fatalf("column %d: got page header %v", i, header)
+		}
+		page, err := snappy.Decode(nil, r.b[:header[3].(int64)])
+		if err != nil || int64(len(page)) != header[2].(int64) {
+			t.Fatalf("column %d: %v", i, err)
+		}
+		columns = append(columns, page)
+	}
+
+	var got []string
+	for p := columns[0]; len(p) > 0; {
+		n := binary.LittleEndian.Uint32(p)
+		got = append(got, string(p[4:4+n]))
+		p = p[4+n:]
+	}
+	if want := []string{`up{job="node"}`, "temperature", "temperature"}; !equalStrings(got, want) {
+		t.Errorf("got series %q, want %q", got, want)
+	}
+	for i, want := range []int64{1000, 1500, 2500} {
+		if ts := int64(binary.LittleEndian.Uint64(columns[1][8*i:])); ts != want {
+			t.Errorf("row %d: got timestamp %d, want %d", i, ts, want)
+		}
+	}
+	for i, want := range []float64{1, -2.5, math.Inf(1)} {
+		if v := math.Float64frombits(binary.LittleEndian.Uint64(columns[2][8*i:])); v != want {
+			t.Errorf("row %d: got value %g, want %g", i, v, want)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -9,13 +9,15 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"go.uber.org/zap"
 )
 
 type writeService interface {
-	Write([]*prompb.TimeSeries)
+	Write(tenant string, req []*prompb.TimeSeries) error
 }
 
-func writeHandler(svc writeService) http.HandlerFunc {
+func writeHandler(svc writeService, limiter *writeLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		compressed, err := ioutil.ReadAll(r.Body)
@@ -36,18 +38,29 @@ func writeHandler(svc writeService) http.HandlerFunc {
 			return
 		}
 
-		svc.Write(req.Timeseries)
-		if err != nil {
+		tenant := limiter.tenant(r)
+		if ok, wait, limit := limiter.allow(tenant, req.Timeseries); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(w, fmt.Sprintf("%s rate limit exceeded", limit), http.StatusTooManyRequests)
+			return
+		}
+
+		if err := svc.Write(tenant, req.Timeseries); err != nil {
+			// rejected samples will be rejected again, so fail without retry
+			if _, ok := err.(*elasticsearch.RejectedError); ok {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, "Error sending samples to remote storage", http.StatusInternalServerError)
 		}
 	}
 }
 
 type readService interface {
-	Read(context.Context, []*prompb.Query) ([]*prompb.QueryResult, error)
+	Read(context.Context, []*prompb.Query, []int64) ([]*prompb.QueryResult, error)
 }
 
-func readHandler(svc readService) http.HandlerFunc {
+func readHandler(logger *zap.Logger, svc readService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		compressed, err := ioutil.ReadAll(r.Body)
@@ -68,14 +81,23 @@ func readHandler(svc readService) http.HandlerFunc {
 			return
 		}
 
-		resp, err := svc.Read(r.Context(), req.Queries)
+		ranges, err := rangeHints(reqBuf)
 		if err != nil {
-
-			fmt.Printf("Error executing query: %s", req.String())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		resp, err := svc.Read(r.Context(), req.Queries, ranges)
+		if err != nil {
+			if isPartialData(err) {
+				logger.Warn("Partial data for query", zap.String("request", req.String()), zap.Error(err))
+			} else {
+				logger.Error("Error executing query", zap.String("request", req.String()), zap.Error(err))
+				http.Error(w, err.Error(), readErrorStatus(err))
+				return
+			}
+		}
+
 		data, err := proto.Marshal(&prompb.ReadResponse{Results: resp})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -92,3 +114,27 @@ func readHandler(svc readService) http.HandlerFunc {
 		}
 	}
 }
+
+// readErrorStatus maps errors returned by the read service to HTTP status codes
+func readErrorStatus(err error) int {
+	e, ok := err.(*elasticsearch.ReadError)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	switch e.Kind {
+	case elasticsearch.ErrBadRequest:
+		return http.StatusBadRequest
+	case elasticsearch.ErrStorage:
+		return http.StatusServiceUnavailable
+	case elasticsearch.ErrLimitExceeded:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// isPartialData reports whether err only signals that part of an otherwise
+// usable result is missing
+func isPartialData(err error) bool {
+	e, ok := err.(*elasticsearch.ReadError)
+	return ok && e.Kind == elasticsearch.ErrPartialData
+}
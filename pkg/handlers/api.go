@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	labelValuesPrefix = "/api/v1/label/"
+	labelValuesSuffix = "/values"
+)
+
+// apiResponse mirrors the envelope of the Prometheus HTTP API so that clients
+// such as Grafana can consume it unchanged
+type apiResponse struct {
+	Status string      `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+func respondJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&apiResponse{Status: "success", Data: data})
+}
+
+func respondJSONError(w http.ResponseWriter, err error, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&apiResponse{Status: "error", Error: err.Error()})
+}
+
+type labelService interface {
+	LabelNames(context.Context) ([]string, error)
+	LabelValues(context.Context, string, []*prompb.LabelMatcher, int64, int64) ([]string, error)
+}
+
+func labelNamesHandler(svc labelService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		names, err := svc.LabelNames(r.Context())
+		if err != nil {
+			respondJSONError(w, err, readErrorStatus(err))
+			return
+		}
+		respondJSON(w, names)
+	}
+}
+
+func labelValuesHandler(svc labelService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, labelValuesSuffix) {
+			http.NotFound(w, r)
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, labelValuesPrefix), labelValuesSuffix)
+		if name == "" {
+			respondJSONError(w, fmt.Errorf("missing label name"), http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			respondJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		start, err := ParseTime(r.Form.Get("start"))
+		if err != nil {
+			respondJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		end, err := ParseTime(r.Form.Get("end"))
+		if err != nil {
+			respondJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		// Each match[] selector is resolved separately and the results merged
+		selectors := r.Form["match[]"]
+		if len(selectors) == 0 {
+			selectors = []string{""}
+		}
+		seen := make(map[string]struct{})
+		values := []string{}
+		for _, s := range selectors {
+			matchers, err := ParseSelector(s)
+			if err != nil {
+				respondJSONError(w, err, http.StatusBadRequest)
+				return
+			}
+			vals, err := svc.LabelValues(r.Context(), name, matchers, start, end)
+			if err != nil {
+				respondJSONError(w, err, readErrorStatus(err))
+				return
+			}
+			for _, v := range vals {
+				if _, ok := seen[v]; !ok {
+					seen[v] = struct{}{}
+					values = append(values, v)
+				}
+			}
+		}
+		if len(selectors) > 1 {
+			sort.Strings(values)
+		}
+		respondJSON(w, values)
+	}
+}
+
+// ParseTime accepts either an RFC3339 timestamp or a (fractional) unix timestamp
+// in seconds, as the Prometheus HTTP API does, and returns milliseconds.
+// An empty string yields zero, leaving the range open.
+func ParseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return int64(sec)*1000 + int64(math.Round(frac*1000)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
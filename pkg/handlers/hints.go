@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// Field numbers of the remote read protobuf messages walked by rangeHints.
+const (
+	readRequestQueries = 1
+	queryHints         = 4
+	readHintsRangeMs   = 7
+)
+
+var errMalformedProto = errors.New("malformed protobuf")
+
+// rangeHints returns the range_ms read hint of each query of a serialized
+// ReadRequest, 0 where it is unset.  The vendored prompb predates the hint and
+// drops it when decoding, so it is read from the wire format directly.
+func rangeHints(buf []byte) ([]int64, error) {
+	var ranges []int64
+	err := walkFields(buf, func(field int, _ uint64, query []byte) error {
+		if field != readRequestQueries {
+			return nil
+		}
+		var rangeMs int64
+		err := walkFields(query, func(field int, _ uint64, hints []byte) error {
+			if field != queryHints {
+				return nil
+			}
+			return walkFields(hints, func(field int, v uint64, _ []byte) error {
+				if field == readHintsRangeMs {
+					rangeMs = int64(v)
+				}
+				return nil
+			})
+		})
+		ranges = append(ranges, rangeMs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// walkFields calls fn with the number of each field of a serialized message
+// and either its numeric value or, for length delimited fields, its bytes.
+func walkFields(buf []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(buf) > 0 {
+		key, n := proto.DecodeVarint(buf)
+		if n == 0 {
+			return errMalformedProto
+		}
+		buf = buf[n:]
+		var (
+			v uint64
+			b []byte
+		)
+		switch key & 7 {
+		case proto.WireVarint:
+			if v, n = proto.DecodeVarint(buf); n == 0 {
+				return errMalformedProto
+			}
+			buf = buf[n:]
+		case proto.WireFixed64:
+			if len(buf) < 8 {
+				return errMalformedProto
+			}
+			buf = buf[8:]
+		case proto.WireBytes:
+			l, n := proto.DecodeVarint(buf)
+			if n == 0 || l > uint64(len(buf)-n) {
+				return errMalformedProto
+			}
+			b, buf = buf[n:n+int(l)], buf[n+int(l):]
+		case proto.WireFixed32:
+			if len(buf) < 4 {
+				return errMalformedProto
+			}
+			buf = buf[4:]
+		default:
+			return errMalformedProto
+		}
+		if err := fn(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
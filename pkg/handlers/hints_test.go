@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestRangeHints(t *testing.T) {
+	query := func(hints *prompb.ReadHints, rangeMs uint64) []byte {
+		q, err := proto.Marshal(&prompb.Query{
+			StartTimestampMs: 1,
+			EndTimestampMs:   2,
+			Matchers:         []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+			Hints:            hints,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rangeMs == 0 {
+			return q
+		}
+		// append range_ms to the hints as a newer Prometheus would
+		h, err := proto.Marshal(hints)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h = append(append(h, readHintsRangeMs<<3|proto.WireVarint), proto.EncodeVarint(rangeMs)...)
+		// the hints field follows the matchers, so it is replaced in place
+		tail, err := proto.Marshal(&prompb.Query{Hints: hints})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q = q[:len(q)-len(tail)]
+		q = append(q, queryHints<<3|proto.WireBytes)
+		q = append(q, proto.EncodeVarint(uint64(len(h)))...)
+		return append(q, h...)
+	}
+	var buf []byte
+	for _, q := range [][]byte{
+		query(&prompb.ReadHints{StepMs: 60000, Func: "rate"}, 300000),
+		query(nil, 0),
+		query(&prompb.ReadHints{StepMs: 60000}, 0),
+	} {
+		buf = append(buf, readRequestQueries<<3|proto.WireBytes)
+		buf = append(buf, proto.EncodeVarint(uint64(len(q)))...)
+		buf = append(buf, q...)
+	}
+
+	var req prompb.ReadRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		t.Fatalf("unexpected error decoding the request: %s", err)
+	}
+	if len(req.Queries) != 3 || req.Queries[0].Hints.Func != "rate" {
+		t.Fatalf("request decoded as %s", req.String())
+	}
+
+	got, err := rangeHints(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []int64{300000, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := rangeHints(buf[:len(buf)-1]); err == nil {
+		t.Error("expected an error for a truncated request")
+	}
+}
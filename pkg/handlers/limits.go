@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"github.com/pwillie/prometheus-es-adapter/pkg/ratelimit"
+)
+
+// WriteLimitConfig configures the per tenant rate limits of write requests.
+// A rate of zero disables the limit.
+type WriteLimitConfig struct {
+	// TenantHeader names the request header identifying the tenant, requests
+	// without it are identified by client address
+	TenantHeader     string
+	SamplesPerSecond float64
+	SamplesBurst     int
+	SeriesPerSecond  float64
+	SeriesBurst      int
+}
+
+// throttledTotal is not labelled by tenant, which may be any client address
+var throttledTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: elasticsearch.Namespace,
+		Name:      "write_throttled_requests_total",
+		Help:      "Number of write requests rejected for exceeding a rate limit",
+	},
+	[]string{"limit"},
+)
+
+func init() {
+	prometheus.MustRegister(throttledTotal)
+}
+
+// writeLimiter enforces WriteLimitConfig
+type writeLimiter struct {
+	header  string
+	samples *ratelimit.Limiter
+	series  *ratelimit.Limiter
+}
+
+func newWriteLimiter(config *WriteLimitConfig) *writeLimiter {
+	l := &writeLimiter{}
+	if config == nil {
+		return l
+	}
+	l.header = config.TenantHeader
+	if config.SamplesPerSecond > 0 {
+		l.samples = ratelimit.New(config.SamplesPerSecond, config.SamplesBurst)
+	}
+	if config.SeriesPerSecond > 0 {
+		l.series = ratelimit.New(config.SeriesPerSecond, config.SeriesBurst)
+	}
+	return l
+}
+
+// tenant identifies who a write request is from
+func (l *writeLimiter) tenant(r *http.Request) string {
+	if l.header != "" {
+		if t := r.Header.Get(l.header); t != "" {
+			return t
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allow takes the samples and series of a write request from the limits of
+// its tenant.  When a limit is exceeded nothing is taken, and the time to wait
+// before retrying is returned along with the name of the limit.
+func (l *writeLimiter) allow(tenant string, req []*prompb.TimeSeries) (bool, time.Duration, string) {
+	if l.samples == nil && l.series == nil {
+		return true, 0, ""
+	}
+	var samples int
+	for _, ts := range req {
+		samples += len(ts.Samples)
+	}
+	now := time.Now()
+	if l.samples != nil {
+		if wait := l.samples.Wait(tenant, samples, now); wait > 0 {
+			throttledTotal.WithLabelValues("samples").Inc()
+			return false, wait, "samples"
+		}
+	}
+	if l.series != nil {
+		if wait := l.series.Wait(tenant, len(req), now); wait > 0 {
+			throttledTotal.WithLabelValues("series").Inc()
+			return false, wait, "series"
+		}
+	}
+	if l.samples != nil {
+		l.samples.Take(tenant, samples, now)
+	}
+	if l.series != nil {
+		l.series.Take(tenant, len(req), now)
+	}
+	return true, 0, ""
+}
+
+// retryAfter formats a wait as a Retry-After header value in whole seconds
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
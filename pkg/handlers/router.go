@@ -5,21 +5,26 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+	"go.uber.org/zap"
 	"gopkg.in/olivere/elastic.v6"
 )
 
 // NewRouter returns a configured http router
-func NewRouter(w *elasticsearch.WriteService, r *elasticsearch.ReadService) *http.ServeMux {
+func NewRouter(logger *zap.Logger, w *elasticsearch.WriteService, r *elasticsearch.ReadService, limits *WriteLimitConfig) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/read", readHandler(r))
-	mux.HandleFunc("/write", writeHandler(w))
+	mux.HandleFunc("/read", readHandler(logger, r))
+	mux.HandleFunc("/write", writeHandler(w, newWriteLimiter(limits)))
+	mux.HandleFunc("/api/v1/labels", labelNamesHandler(r))
+	mux.HandleFunc(labelValuesPrefix, labelValuesHandler(r))
 	return mux
 }
 
-// NewAdminRouter returns a configured http router for prom metrics and health checks
-func NewAdminRouter(client *elastic.Client) *http.ServeMux {
+// NewAdminRouter returns a configured http router for prom metrics, health checks
+// and storage analytics
+func NewAdminRouter(client *elastic.Client, r *elasticsearch.ReadService) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", prometheus.Handler())
+	mux.HandleFunc("/api/v1/status/tsdb", tsdbStatusHandler(r))
 	// creates /live and /ready endpoints
 	mux.Handle("/", healthzHandler(client))
 	return mux
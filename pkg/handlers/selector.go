@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ParseSelector parses a PromQL series selector such as
+// `up{job="prometheus",instance=~"localhost.*"}` into label matchers.
+// Only plain selectors are supported, not arbitrary PromQL expressions.
+func ParseSelector(s string) ([]*prompb.LabelMatcher, error) {
+	p := &selectorParser{input: s}
+	matchers, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %s", s, err)
+	}
+	return matchers, nil
+}
+
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) parse() ([]*prompb.LabelMatcher, error) {
+	var matchers []*prompb.LabelMatcher
+
+	p.skipSpace()
+	if name := p.identifier(true); name != "" {
+		matchers = append(matchers, &prompb.LabelMatcher{
+			Type:  prompb.LabelMatcher_EQ,
+			Name:  "__name__",
+			Value: name,
+		})
+	}
+	p.skipSpace()
+	if p.peek() == '{' {
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.peek() == '}' {
+				p.pos++
+				break
+			}
+			m, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, m)
+			p.skipSpace()
+			switch p.peek() {
+			case ',':
+				p.pos++
+			case '}':
+			default:
+				return nil, fmt.Errorf("expected ',' or '}' at position %d", p.pos)
+			}
+		}
+	}
+	p.skipSpace()
+	if p.pos != len(p.input) {
+		return nil, fmt.Errorf("unexpected character at position %d", p.pos)
+	}
+	return matchers, nil
+}
+
+func (p *selectorParser) matcher() (*prompb.LabelMatcher, error) {
+	name := p.identifier(false)
+	if name == "" {
+		return nil, fmt.Errorf("expected label name at position %d", p.pos)
+	}
+	p.skipSpace()
+
+	var t prompb.LabelMatcher_Type
+	rest := p.input[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, "=~"):
+		t = prompb.LabelMatcher_RE
+		p.pos += 2
+	case strings.HasPrefix(rest, "!~"):
+		t = prompb.LabelMatcher_NRE
+		p.pos += 2
+	case strings.HasPrefix(rest, "!="):
+		t = prompb.LabelMatcher_NEQ
+		p.pos += 2
+	case strings.HasPrefix(rest, "="):
+		t = prompb.LabelMatcher_EQ
+		p.pos++
+	default:
+		return nil, fmt.Errorf("expected match operator at position %d", p.pos)
+	}
+	p.skipSpace()
+
+	value, err := p.quoted()
+	if err != nil {
+		return nil, err
+	}
+	return &prompb.LabelMatcher{Type: t, Name: name, Value: value}, nil
+}
+
+// identifier consumes a label name, or a metric name which may also contain colons
+func (p *selectorParser) identifier(metric bool) string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := rune(p.input[p.pos])
+		valid := c == '_' || unicode.IsLetter(c) || (p.pos > start && unicode.IsDigit(c)) || (metric && c == ':')
+		if !valid || c > unicode.MaxASCII {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *selectorParser) quoted() (string, error) {
+	quote := p.peek()
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", fmt.Errorf("expected quoted string at position %d", p.pos)
+	}
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '\\' && quote != '`' {
+			p.pos += 2
+			continue
+		}
+		p.pos++
+		if c == quote {
+			raw := p.input[start:p.pos]
+			if quote == '\'' {
+				raw = doubleQuote(raw[1 : len(raw)-1])
+			}
+			return strconv.Unquote(raw)
+		}
+	}
+	return "", fmt.Errorf("unterminated string starting at position %d", start)
+}
+
+// doubleQuote rewrites the body of a single-quoted string as a double-quoted
+// one, since strconv only understands single quotes around a single rune
+func doubleQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			b.WriteString(s[i : i+2])
+			i++
+		case s[i] == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func (p *selectorParser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *selectorParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestParseSelector(t *testing.T) {
+	eq := prompb.LabelMatcher_EQ
+	tests := []struct {
+		selector string
+		want     []*prompb.LabelMatcher
+	}{
+		{`up`, []*prompb.LabelMatcher{
+			{Type: eq, Name: "__name__", Value: "up"},
+		}},
+		{` node:cpu_seconds:rate5m `, []*prompb.LabelMatcher{
+			{Type: eq, Name: "__name__", Value: "node:cpu_seconds:rate5m"},
+		}},
+		{`{}`, nil},
+		{`{job="prometheus"}`, []*prompb.LabelMatcher{
+			{Type: eq, Name: "job", Value: "prometheus"},
+		}},
+		{`up{job="prometheus",instance=~"localhost.*"}`, []*prompb.LabelMatcher{
+			{Type: eq, Name: "__name__", Value: "up"},
+			{Type: eq, Name: "job", Value: "prometheus"},
+			{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "localhost.*"},
+		}},
+		{`up{ job != "a" , env !~ "dev|test", }`, []*prompb.LabelMatcher{
+			{Type: eq, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "a"},
+			{Type: prompb.LabelMatcher_NRE, Name: "env", Value: "dev|test"},
+		}},
+		{`{path="C:\\tmp\n\"x\""}`, []*prompb.LabelMatcher{
+			{Type: eq, Name: "path", Value: "C:\\tmp\n\"x\""},
+		}},
+		{`{a='it\'s "quoted"'}`, []*prompb.LabelMatcher{
+			{Type: eq, Name: "a", Value: `it's "quoted"`},
+		}},
+		{"{a=`raw\\d+`}", []*prompb.LabelMatcher{
+			{Type: eq, Name: "a", Value: `raw\d+`},
+		}},
+		{`{a="ünïcode"}`, []*prompb.LabelMatcher{
+			{Type: eq, Name: "a", Value: "ünïcode"},
+		}},
+	}
+	for _, test := range tests {
+		got, err := ParseSelector(test.selector)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.selector, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.selector, got, test.want)
+		}
+	}
+}
+
+func TestParseSelectorMalformed(t *testing.T) {
+	for _, selector := range []string{
+		`1up`,
+		`up job`,
+		`up}`,
+		`up{`,
+		`up{,}`,
+		`up{job}`,
+		`up{job=}`,
+		`up{job=prometheus}`,
+		`up{job=="a"}`,
+		`up{job~="a"}`,
+		`up{1job="a"}`,
+		`up{job="a"`,
+		`up{job="a" instance="b"}`,
+		`up{job="a}`,
+		`up{job="a\`,
+		`up{job='a\'}`,
+		`up{job="\q"}`,
+		`up{job="a"}}`,
+		`rate(up[5m])`,
+	} {
+		if _, err := ParseSelector(selector); err == nil {
+			t.Errorf("%s: expected an error", selector)
+		}
+	}
+}
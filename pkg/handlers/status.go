@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pwillie/prometheus-es-adapter/pkg/elasticsearch"
+)
+
+const defaultStatusLimit = 10
+
+type statusService interface {
+	TSDBStatus(context.Context, int) (*elasticsearch.TSDBStatus, error)
+}
+
+func tsdbStatusHandler(svc statusService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultStatusLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			l, err := strconv.Atoi(s)
+			if err != nil || l <= 0 {
+				respondJSONError(w, fmt.Errorf("invalid limit %q", s), http.StatusBadRequest)
+				return
+			}
+			limit = l
+		}
+		status, err := svc.TSDBStatus(r.Context(), limit)
+		if err != nil {
+			respondJSONError(w, err, readErrorStatus(err))
+			return
+		}
+		respondJSON(w, status)
+	}
+}
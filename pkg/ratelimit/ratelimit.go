@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a set of token buckets, one per key, refilled at a fixed rate up
+// to a burst size.  Buckets which have refilled are indistinguishable from new
+// ones and are evicted, so only keys active within the time to refill an empty
+// bucket are held in memory.
+type Limiter struct {
+	rate  float64
+	burst float64
+	// fill is the time to refill an empty bucket, and how often full buckets
+	// are evicted
+	fill time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// New returns a Limiter allowing rate tokens per second per key, with bursts
+// of up to burst tokens
+func New(rate float64, burst int) *Limiter {
+	fill := time.Duration(float64(burst) / rate * float64(time.Second))
+	if fill < time.Second {
+		fill = time.Second
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		fill:    fill,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Wait returns how long the bucket of key needs to refill before n tokens can
+// be taken, zero when they are available now.  Requests for more than the
+// burst size wait for a full bucket.
+func (l *Limiter) Wait(key string, n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	missing := math.Min(float64(n), l.burst) - l.refill(key, now).tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / l.rate * float64(time.Second))
+}
+
+// Take removes n tokens from the bucket of key, which may leave it in debt
+func (l *Limiter) Take(key string, n int, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(key, now).tokens -= float64(n)
+}
+
+// Acquire waits until n tokens are available in the bucket of key and takes
+// them, or returns the error of ctx when it is done first
+func (l *Limiter) Acquire(ctx context.Context, key string, n int) error {
+	if wait := l.Wait(key, n, time.Now()); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	l.Take(key, n, time.Now())
+	return nil
+}
+
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	if now.Sub(l.swept) >= l.fill {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	return b
+}
+
+// sweep evicts the buckets which have refilled by now
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
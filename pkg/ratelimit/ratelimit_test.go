@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterEvictsFullBuckets(t *testing.T) {
+	l := New(10, 100)
+	now := time.Now()
+	l.Take("a", 150, now)
+	l.Take("b", 50, now)
+	if wait := l.Wait("a", 10, now); wait != 6*time.Second {
+		t.Errorf("got wait %s, want 6s", wait)
+	}
+
+	// buckets are swept every 10s, the time to refill an empty one, by when b
+	// has refilled and a, left in debt, has not
+	now = now.Add(10 * time.Second)
+	l.Take("c", 1, now)
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("full bucket b was not evicted")
+	}
+	if _, ok := l.buckets["a"]; !ok {
+		t.Error("bucket a was evicted before refilling")
+	}
+	if wait := l.Wait("a", 60, now); wait != time.Second {
+		t.Errorf("got wait %s, want 1s", wait)
+	}
+
+	// every bucket has refilled, so the limiter holds only the one in use
+	now = now.Add(20 * time.Second)
+	if wait := l.Wait("d", 100, now); wait != 0 {
+		t.Errorf("got wait %s, want 0", wait)
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("got %d buckets, want 1", len(l.buckets))
+	}
+}
@@ -0,0 +1,358 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// The on-disk format of Prometheus TSDB blocks is read and written directly, as
+// the Prometheus tsdb package is not a dependency.  See
+// https://github.com/prometheus/prometheus/tree/main/tsdb/docs/format
+const (
+	indexMagic   = 0xBAAAD700
+	indexV2      = 2
+	indexTOCLen  = 6*8 + 4
+	chunksMagic  = 0x85BD40DD
+	chunksHeader = 8
+	encodingXOR  = 1
+	// tombstonesMagic starts the file of deleted ranges of a block
+	tombstonesMagic = 0x0130BA30
+	// tombstonesEmpty is the size of a tombstones file without tombstones,
+	// its magic, version and checksum
+	tombstonesEmpty = 4 + 1 + 4
+)
+
+// BlockMeta is the meta.json of a block
+type BlockMeta struct {
+	ULID string `json:"ulid"`
+	// MinTime is inclusive and MaxTime exclusive
+	MinTime int64 `json:"minTime"`
+	MaxTime int64 `json:"maxTime"`
+	Stats   struct {
+		NumSamples uint64 `json:"numSamples"`
+		NumSeries  uint64 `json:"numSeries"`
+		NumChunks  uint64 `json:"numChunks"`
+	} `json:"stats"`
+	Compaction struct {
+		Level   int      `json:"level"`
+		Sources []string `json:"sources"`
+	} `json:"compaction"`
+	Version int `json:"version"`
+}
+
+// Block reads the series and samples of a TSDB block directory.  The index is
+// held in memory, chunks are read from their segment files as needed.
+type Block struct {
+	Meta BlockMeta
+
+	dir      string
+	index    []byte
+	symbols  []string
+	series   int // offset of the series section
+	end      int // end of the series section
+	segments []*os.File
+}
+
+// IsBlock reports whether path is a TSDB block directory
+func IsBlock(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "meta.json"))
+	return err == nil
+}
+
+// OpenBlock opens the block in dir, which must have a version 2 index
+func OpenBlock(dir string) (*Block, error) {
+	b := &Block{dir: dir}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.Meta); err != nil {
+		return nil, fmt.Errorf("decoding meta.json: %s", err)
+	}
+	if b.index, err = ioutil.ReadFile(filepath.Join(dir, "index")); err != nil {
+		return nil, err
+	}
+	if err := b.readTOC(); err != nil {
+		return nil, err
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "chunks", "[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	for _, path := range segments {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.segments = append(b.segments, f)
+		var header [chunksHeader]byte
+		if _, err := f.ReadAt(header[:], 0); err != nil || binary.BigEndian.Uint32(header[:]) != chunksMagic {
+			b.Close()
+			return nil, fmt.Errorf("%s is not a chunks segment", path)
+		}
+	}
+	return b, nil
+}
+
+// HasTombstones reports whether samples of the block have been deleted
+func (b *Block) HasTombstones() bool {
+	info, err := os.Stat(filepath.Join(b.dir, "tombstones"))
+	return err == nil && info.Size() > tombstonesEmpty
+}
+
+// Interval is a time range of a series whose samples were deleted, with both
+// bounds inclusive
+type Interval struct {
+	Mint, Maxt int64
+}
+
+// Deleted reports whether t falls within one of the intervals
+func Deleted(t int64, intervals []Interval) bool {
+	for _, iv := range intervals {
+		if t >= iv.Mint && t <= iv.Maxt {
+			return true
+		}
+	}
+	return false
+}
+
+// Tombstones reads the deleted intervals of the block by series reference
+func (b *Block) Tombstones() (map[uint64][]Interval, error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.dir, "tombstones"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < tombstonesEmpty || binary.BigEndian.Uint32(data) != tombstonesMagic || data[4] != 1 {
+		return nil, fmt.Errorf("invalid tombstones file")
+	}
+	entries := data[5 : len(data)-4]
+	if crc32.Checksum(entries, castagnoli) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("tombstones checksum mismatch")
+	}
+	tombstones := make(map[uint64][]Interval)
+	d := decoder{b: entries}
+	for d.off < len(entries) && d.err == nil {
+		ref := d.uvarint()
+		iv := Interval{Mint: d.varint(), Maxt: d.varint()}
+		tombstones[ref] = append(tombstones[ref], iv)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid tombstones: %s", d.err)
+	}
+	return tombstones, nil
+}
+
+// Close closes the chunk segment files
+func (b *Block) Close() error {
+	for _, f := range b.segments {
+		f.Close()
+	}
+	return nil
+}
+
+// readTOC locates the symbol and series sections and reads the symbols
+func (b *Block) readTOC() error {
+	if len(b.index) < 5+indexTOCLen || binary.BigEndian.Uint32(b.index) != indexMagic {
+		return fmt.Errorf("invalid index")
+	}
+	if v := b.index[4]; v != indexV2 {
+		return fmt.Errorf("unsupported index version %d", v)
+	}
+	tocStart := len(b.index) - indexTOCLen
+	toc := make([]int, 6)
+	for i := range toc {
+		toc[i] = int(binary.BigEndian.Uint64(b.index[tocStart+8*i:]))
+		if toc[i] > tocStart {
+			return fmt.Errorf("invalid index table of contents")
+		}
+	}
+	b.series = toc[1]
+	// the series section runs up to the next section present
+	b.end = tocStart
+	for _, off := range toc[2:] {
+		if off > b.series && off < b.end {
+			b.end = off
+		}
+	}
+
+	d := decoder{b: b.index, off: toc[0] + 4}
+	n := int(d.be32())
+	b.symbols = make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b.symbols = append(b.symbols, d.uvarintStr())
+	}
+	return d.err
+}
+
+// Series is a series of a block with the references of its chunks
+type Series struct {
+	// Ref is the reference of the series within the index, by which
+	// tombstones identify it
+	Ref    uint64
+	Labels []*prompb.Label
+	Chunks []uint64
+}
+
+// ForEachSeries calls fn with every series of the block from the skip'th on,
+// in index order
+func (b *Block) ForEachSeries(skip int, fn func(i int, s *Series) error) error {
+	off := b.series
+	for i := 0; ; i++ {
+		// series entries are 16 byte aligned, their reference being the
+		// offset divided by 16
+		off = (off + 15) / 16 * 16
+		if off >= b.end {
+			return nil
+		}
+		d := decoder{b: b.index, off: off}
+		n := int(d.uvarint())
+		if d.err != nil || n == 0 {
+			return d.err
+		}
+		next := d.off + n + 4
+		if i >= skip {
+			s, err := b.decodeSeries(d.off, next-4)
+			if err != nil {
+				return fmt.Errorf("series at %d: %s", off, err)
+			}
+			s.Ref = uint64(off / 16)
+			if err := fn(i, s); err != nil {
+				return err
+			}
+		}
+		off = next
+	}
+}
+
+func (b *Block) decodeSeries(start, end int) (*Series, error) {
+	d := decoder{b: b.index[:end], off: start}
+	s := &Series{}
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		name, value := d.uvarint(), d.uvarint()
+		if name >= uint64(len(b.symbols)) || value >= uint64(len(b.symbols)) {
+			return nil, fmt.Errorf("unknown symbol")
+		}
+		s.Labels = append(s.Labels, &prompb.Label{
+			Name:  b.symbols[name],
+			Value: b.symbols[value],
+		})
+	}
+	var ref uint64
+	for i, n := 0, d.uvarint(); uint64(i) < n && d.err == nil; i++ {
+		// chunk time ranges are only needed to query blocks, so are skipped
+		if i == 0 {
+			d.varint()
+			d.uvarint()
+			ref = d.uvarint()
+		} else {
+			d.uvarint()
+			d.uvarint()
+			ref = uint64(int64(ref) + d.varint())
+		}
+		s.Chunks = append(s.Chunks, ref)
+	}
+	return s, d.err
+}
+
+// Samples reads and decodes a chunk.  Chunks of other encodings than XOR, such
+// as native histograms, are reported as errors.
+func (b *Block) Samples(ref uint64) ([]prompb.Sample, error) {
+	seq, off := int(ref>>32), int64(uint32(ref))
+	if seq >= len(b.segments) {
+		return nil, fmt.Errorf("chunk %d references missing segment %d", ref, seq)
+	}
+	f := b.segments[seq]
+	var header [binary.MaxVarintLen32 + 1]byte
+	n, err := f.ReadAt(header[:], off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	length, k := binary.Uvarint(header[:n])
+	if k <= 0 || k >= n {
+		return nil, fmt.Errorf("invalid chunk %d", ref)
+	}
+	if enc := header[k]; enc != encodingXOR {
+		return nil, fmt.Errorf("unsupported chunk encoding %d", enc)
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, off+int64(k)+1); err != nil {
+		return nil, err
+	}
+	return decodeXOR(data)
+}
+
+// decoder reads the fields of index sections, remembering the first error
+type decoder struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (d *decoder) be32() uint32 {
+	if d.err != nil || d.off+4 > len(d.b) {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b[d.off:])
+	d.off += 4
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil || d.off >= len(d.b) {
+		d.fail()
+		return 0
+	}
+	v, n := binary.Uvarint(d.b[d.off:])
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.off += n
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil || d.off >= len(d.b) {
+		d.fail()
+		return 0
+	}
+	v, n := binary.Varint(d.b[d.off:])
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.off += n
+	return v
+}
+
+func (d *decoder) uvarintStr() string {
+	n := int(d.uvarint())
+	if d.err != nil || d.off+n > len(d.b) {
+		d.fail()
+		return ""
+	}
+	s := string(d.b[d.off : d.off+n])
+	d.off += n
+	return s
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("invalid index at offset %d", d.off)
+	}
+}
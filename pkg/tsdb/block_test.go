@@ -0,0 +1,218 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// fixtureBlock was built by hand to the Prometheus block format, with every
+// index section, an empty tombstones file and a series of two chunks
+const fixtureBlock = "testdata/01ARZ3NDEKTSV4RRFFQ69G5FAV"
+
+func TestIsBlock(t *testing.T) {
+	if !IsBlock(fixtureBlock) {
+		t.Errorf("%s is not recognised as a block", fixtureBlock)
+	}
+	if IsBlock("testdata") {
+		t.Errorf("testdata is recognised as a block")
+	}
+}
+
+func TestOpenBlock(t *testing.T) {
+	b, err := OpenBlock(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if b.Meta.ULID != "01ARZ3NDEKTSV4RRFFQ69G5FAV" || b.Meta.MinTime != 1000 || b.Meta.MaxTime != 76001 {
+		t.Errorf("unexpected meta %+v", b.Meta)
+	}
+	if b.Meta.Stats.NumSeries != 2 || b.Meta.Stats.NumChunks != 3 || b.Meta.Stats.NumSamples != 10 {
+		t.Errorf("unexpected stats %+v", b.Meta.Stats)
+	}
+	if b.HasTombstones() {
+		t.Errorf("empty tombstones reported")
+	}
+
+	want := []struct {
+		labels  []*prompb.Label
+		samples []prompb.Sample
+	}{
+		{
+			labels: []*prompb.Label{
+				{Name: "__name__", Value: "node_load1"},
+				{Name: "instance", Value: "host:9100"},
+				{Name: "job", Value: "node"},
+			},
+			samples: []prompb.Sample{
+				{Timestamp: 1000, Value: 0.5},
+				{Timestamp: 16000, Value: 0.75},
+				{Timestamp: 31000, Value: 0.75},
+				{Timestamp: 46000, Value: 1.25},
+				{Timestamp: 61000, Value: 2},
+				{Timestamp: 76000, Value: math.Float64frombits(staleNaNBits)},
+			},
+		},
+		{
+			labels: []*prompb.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "instance", Value: "host:9100"},
+				{Name: "job", Value: "node"},
+			},
+			samples: []prompb.Sample{
+				{Timestamp: 1000, Value: 1},
+				{Timestamp: 16000, Value: 1},
+				{Timestamp: 31000, Value: 0},
+				{Timestamp: 46500, Value: 1},
+			},
+		},
+	}
+	var n int
+	err = b.ForEachSeries(0, func(i int, s *Series) error {
+		if i != n || i >= len(want) {
+			t.Fatalf("unexpected series %d", i)
+		}
+		n++
+		if !reflect.DeepEqual(s.Labels, want[i].labels) {
+			t.Errorf("series %d: got labels %v, want %v", i, s.Labels, want[i].labels)
+		}
+		var samples []prompb.Sample
+		for _, ref := range s.Chunks {
+			chunk, err := b.Samples(ref)
+			if err != nil {
+				t.Fatalf("series %d: chunk %d: %s", i, ref, err)
+			}
+			samples = append(samples, chunk...)
+		}
+		sameSamples(t, samples, want[i].samples)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Errorf("got %d series, want %d", n, len(want))
+	}
+}
+
+func TestForEachSeriesSkip(t *testing.T) {
+	b, err := OpenBlock(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var seen []int
+	err = b.ForEachSeries(1, func(i int, s *Series) error {
+		seen = append(seen, i)
+		if name := s.Labels[0].Value; name != "up" {
+			t.Errorf("series %d: got %s, want up", i, name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seen, []int{1}) {
+		t.Errorf("got series %v, want [1]", seen)
+	}
+}
+
+func TestSamplesMissingSegment(t *testing.T) {
+	b, err := OpenBlock(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.Samples(1 << 32); err == nil {
+		t.Errorf("expected an error for a chunk in a missing segment")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "chunks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"meta.json", "index", filepath.Join("chunks", "000001")} {
+		data, err := ioutil.ReadFile(filepath.Join(fixtureBlock, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := OpenBlock(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var refs []uint64
+	err = b.ForEachSeries(0, func(i int, s *Series) error {
+		refs = append(refs, s.Ref)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tombstones, err := b.Tombstones(); err != nil || len(tombstones) != 0 {
+		t.Fatalf("got tombstones %v, %v without a tombstones file", tombstones, err)
+	}
+
+	// as Prometheus writes them, one entry per deleted interval
+	want := map[uint64][]Interval{
+		refs[1]: {{Mint: 16000, Maxt: 31000}, {Mint: 46000, Maxt: 50000}},
+		refs[0]: {{Mint: -1000, Maxt: 1000}},
+	}
+	var entries []byte
+	for _, ref := range refs {
+		for _, iv := range want[ref] {
+			entries = append(entries, make([]byte, 3*binary.MaxVarintLen64)...)
+			n := len(entries) - 3*binary.MaxVarintLen64
+			n += binary.PutUvarint(entries[n:], ref)
+			n += binary.PutVarint(entries[n:], iv.Mint)
+			n += binary.PutVarint(entries[n:], iv.Maxt)
+			entries = entries[:n]
+		}
+	}
+	data := append(putBE32(nil, tombstonesMagic), 1)
+	data = append(data, entries...)
+	data = putBE32(data, crc32.Checksum(entries, castagnoli))
+	if err := ioutil.WriteFile(filepath.Join(dir, "tombstones"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !b.HasTombstones() {
+		t.Error("tombstones not reported")
+	}
+	got, err := b.Tombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got tombstones %v, want %v", got, want)
+	}
+	for ts, deleted := range map[int64]bool{1000: false, 16000: true, 31000: true, 46000: true, 46500: true, 50001: false} {
+		if Deleted(ts, got[refs[1]]) != deleted {
+			t.Errorf("sample at %d: got deleted %t, want %t", ts, !deleted, deleted)
+		}
+	}
+
+	data[len(data)-1]++
+	if err := ioutil.WriteFile(filepath.Join(dir, "tombstones"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Tombstones(); err == nil {
+		t.Error("expected an error for a corrupted tombstones file")
+	}
+}
@@ -0,0 +1,226 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// maxChunkSamples is the most samples Prometheus puts in a chunk
+const maxChunkSamples = 120
+
+// encodeXOR encodes up to maxChunkSamples samples, in timestamp order, as a
+// Gorilla XOR chunk the way Prometheus does
+func encodeXOR(samples []prompb.Sample) []byte {
+	w := &bitWriter{}
+	var (
+		t, delta          int64
+		v                 uint64
+		leading, trailing uint8 = 0xff, 0
+	)
+	buf := make([]byte, binary.MaxVarintLen64)
+	for i, s := range samples {
+		value := math.Float64bits(s.Value)
+		switch i {
+		case 0:
+			for _, b := range buf[:binary.PutVarint(buf, s.Timestamp)] {
+				w.writeBits(uint64(b), 8)
+			}
+			w.writeBits(value, 64)
+		case 1:
+			delta = s.Timestamp - t
+			for _, b := range buf[:binary.PutUvarint(buf, uint64(delta))] {
+				w.writeBits(uint64(b), 8)
+			}
+			leading, trailing = w.writeXOR(value^v, leading, trailing)
+		default:
+			dod := s.Timestamp - t - delta
+			delta = s.Timestamp - t
+			switch {
+			case dod == 0:
+				w.writeBits(0, 1)
+			case bitRange(dod, 14):
+				w.writeBits(0x02, 2)
+				w.writeBits(uint64(dod), 14)
+			case bitRange(dod, 17):
+				w.writeBits(0x06, 3)
+				w.writeBits(uint64(dod), 17)
+			case bitRange(dod, 20):
+				w.writeBits(0x0e, 4)
+				w.writeBits(uint64(dod), 20)
+			default:
+				w.writeBits(0x0f, 4)
+				w.writeBits(uint64(dod), 64)
+			}
+			leading, trailing = w.writeXOR(value^v, leading, trailing)
+		}
+		t, v = s.Timestamp, value
+	}
+	return append([]byte{byte(len(samples) >> 8), byte(len(samples))}, w.b...)
+}
+
+// bitRange reports whether x fits the nbits wide delta of delta encoding
+func bitRange(x int64, nbits uint) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+// bitWriter writes a big endian bit stream
+type bitWriter struct {
+	b []byte
+	n uint
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for ; n > 0; n-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		if v>>(n-1)&1 == 1 {
+			w.b[len(w.b)-1] |= 1 << (7 - w.n%8)
+		}
+		w.n++
+	}
+}
+
+// writeXOR writes the XOR of a value with the previous one, reusing the
+// previous leading and trailing zero counts when they fit
+func (w *bitWriter) writeXOR(x uint64, leading, trailing uint8) (uint8, uint8) {
+	if x == 0 {
+		w.writeBits(0, 1)
+		return leading, trailing
+	}
+	w.writeBits(1, 1)
+	l, t := uint8(bits.LeadingZeros64(x)), uint8(bits.TrailingZeros64(x))
+	if l >= 32 {
+		// the count is written in 5 bits
+		l = 31
+	}
+	if leading != 0xff && l >= leading && t >= trailing {
+		w.writeBits(0, 1)
+		w.writeBits(x>>trailing, uint(64-leading-trailing))
+		return leading, trailing
+	}
+	significant := 64 - l - t
+	w.writeBits(1, 1)
+	w.writeBits(uint64(l), 5)
+	// 64 significant bits are written as 0
+	w.writeBits(uint64(significant), 6)
+	w.writeBits(x>>t, uint(significant))
+	return l, t
+}
+
+// decodeXOR decodes a Gorilla XOR chunk: delta of delta encoded timestamps
+// and XOR encoded values
+func decodeXOR(data []byte) ([]prompb.Sample, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("truncated chunk")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	r := &bitReader{b: data[2:]}
+	samples := make([]prompb.Sample, 0, n)
+	var (
+		t, delta          int64
+		v                 uint64
+		leading, trailing uint64
+	)
+	for i := 0; i < n; i++ {
+		switch i {
+		case 0:
+			var err error
+			if t, err = binary.ReadVarint(r); err != nil {
+				return nil, err
+			}
+			v = r.bits(64)
+		case 1:
+			d, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			delta = int64(d)
+			t += delta
+			v, leading, trailing = r.xor(v, leading, trailing)
+		default:
+			var size uint
+			switch {
+			case !r.bit():
+			case !r.bit():
+				size = 14
+			case !r.bit():
+				size = 17
+			case !r.bit():
+				size = 20
+			default:
+				size = 64
+			}
+			if size > 0 {
+				bits := r.bits(size)
+				if size < 64 && bits > 1<<(size-1) {
+					bits -= 1 << size
+				}
+				delta += int64(bits)
+			}
+			t += delta
+			v, leading, trailing = r.xor(v, leading, trailing)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		samples = append(samples, prompb.Sample{
+			Timestamp: t,
+			Value:     math.Float64frombits(v),
+		})
+	}
+	return samples, nil
+}
+
+// bitReader reads a big endian bit stream, remembering the first error
+type bitReader struct {
+	b   []byte
+	pos uint
+	err error
+}
+
+func (r *bitReader) bit() bool {
+	return r.bits(1) == 1
+}
+
+func (r *bitReader) bits(n uint) uint64 {
+	var v uint64
+	for ; n > 0; n-- {
+		i := r.pos / 8
+		if i >= uint(len(r.b)) {
+			r.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		v = v<<1 | uint64(r.b[i]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+// ReadByte lets varints be read from the stream
+func (r *bitReader) ReadByte() (byte, error) {
+	v := byte(r.bits(8))
+	return v, r.err
+}
+
+// xor reads a value XOR encoded against the previous one, along with the
+// leading and trailing zero counts following values may reuse
+func (r *bitReader) xor(prev, leading, trailing uint64) (uint64, uint64, uint64) {
+	if !r.bit() {
+		return prev, leading, trailing
+	}
+	if r.bit() {
+		leading = r.bits(5)
+		significant := r.bits(6)
+		if significant == 0 {
+			significant = 64
+		}
+		trailing = 64 - leading - significant
+	}
+	return prev ^ r.bits(uint(64-leading-trailing))<<trailing, leading, trailing
+}
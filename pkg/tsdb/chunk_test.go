@@ -0,0 +1,148 @@
+package tsdb
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// staleNaNBits is the bit pattern of Prometheus staleness markers
+const staleNaNBits uint64 = 0x7ff0000000000002
+
+// sameSamples compares samples by value bits, so NaNs and staleness markers
+// must be kept exactly
+func sameSamples(t *testing.T, got, want []prompb.Sample) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Timestamp != want[i].Timestamp || math.Float64bits(got[i].Value) != math.Float64bits(want[i].Value) {
+			t.Errorf("sample %d: got %v@%d, want %v@%d", i, got[i].Value, got[i].Timestamp, want[i].Value, want[i].Timestamp)
+		}
+	}
+}
+
+func TestEncodeXOR(t *testing.T) {
+	// a varint first timestamp and raw first value, a uvarint delta, then
+	// single zero bits for repeated deltas and values
+	want := []byte{
+		0x00, 0x03,
+		0xd0, 0x0f,
+		0x3f, 0xf0, 0, 0, 0, 0, 0, 0,
+		0xe8, 0x07,
+		0x00,
+	}
+	got := encodeXOR([]prompb.Sample{
+		{Timestamp: 1000, Value: 1},
+		{Timestamp: 2000, Value: 1},
+		{Timestamp: 3000, Value: 1},
+	})
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestBitRange(t *testing.T) {
+	tests := []struct {
+		x     int64
+		nbits uint
+		want  bool
+	}{
+		{8192, 14, true},
+		{8193, 14, false},
+		{-8191, 14, true},
+		{-8192, 14, false},
+		{65536, 17, true},
+		{65537, 17, false},
+		{-65535, 17, true},
+		{-65536, 17, false},
+		{524288, 20, true},
+		{524289, 20, false},
+		{-524287, 20, true},
+		{-524288, 20, false},
+	}
+	for _, test := range tests {
+		if got := bitRange(test.x, test.nbits); got != test.want {
+			t.Errorf("bitRange(%d, %d) = %t, want %t", test.x, test.nbits, got, test.want)
+		}
+	}
+}
+
+func TestXORTimestamps(t *testing.T) {
+	// delta of deltas at the edges of the 14, 17 and 20 bit buckets and
+	// beyond, which take 64 bits
+	dods := []int64{
+		0, 1, -1,
+		8192, -8191, 8193, -8192,
+		65536, -65535, 65537, -65536,
+		524288, -524287, 524289, -524288,
+		1 << 40, -(1 << 40), math.MaxInt32, math.MinInt32,
+	}
+	samples := []prompb.Sample{{Timestamp: 1600000000000}, {Timestamp: 1600000015000}}
+	delta := int64(15000)
+	for _, dod := range dods {
+		delta += dod
+		samples = append(samples, prompb.Sample{
+			Timestamp: samples[len(samples)-1].Timestamp + delta,
+			Value:     float64(len(samples)),
+		})
+	}
+	got, err := decodeXOR(encodeXOR(samples))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameSamples(t, got, samples)
+}
+
+func TestXORValues(t *testing.T) {
+	tests := map[string][]float64{
+		"repeated":  {1, 1, 1, 1},
+		"integers":  {0, 1, 2, 3, 1000, -1000, 1e9},
+		"fractions": {0.1, 0.2, 0.30000000000000004, 1.0 / 3, math.Pi, math.E},
+		// a XOR with 64 significant bits has its length written as 0
+		"64 significant bits": {1, math.Float64frombits(0x8000000000000001), 1},
+		// more than 31 leading zeros are written as 31
+		"leading zeros": {1, math.Nextafter(1, 2), 1, math.Nextafter(1, 0)},
+		// a narrower XOR reuses the previous leading and trailing zeros
+		"reused window": {1, math.Float64frombits(0x3ff00000000000f0), math.Float64frombits(0x3ff0000000000030)},
+		"special": {
+			math.Float64frombits(staleNaNBits),
+			math.NaN(),
+			math.Inf(1),
+			math.Inf(-1),
+			0,
+			math.Copysign(0, -1),
+			math.Float64frombits(staleNaNBits),
+			math.SmallestNonzeroFloat64,
+			math.MaxFloat64,
+		},
+	}
+	for name, values := range tests {
+		samples := make([]prompb.Sample, len(values))
+		for i, v := range values {
+			samples[i] = prompb.Sample{Timestamp: int64(i) * 15000, Value: v}
+		}
+		got, err := decodeXOR(encodeXOR(samples))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		t.Run(name, func(t *testing.T) { sameSamples(t, got, samples) })
+	}
+}
+
+func TestDecodeXORTruncated(t *testing.T) {
+	data := encodeXOR([]prompb.Sample{
+		{Timestamp: 1000, Value: 1},
+		{Timestamp: 2000, Value: 2},
+		{Timestamp: 3500, Value: 4},
+	})
+	for _, n := range []int{0, 1, 5, len(data) - 1} {
+		if _, err := decodeXOR(data[:n]); err == nil {
+			t.Errorf("decoding %d of %d bytes: expected an error", n, len(data))
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package tsdb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// maxSegmentSize is the size chunk segment files are cut at, as in Prometheus
+const maxSegmentSize = 512 * 1024 * 1024
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// BlockWriter writes series into a new TSDB block.  Chunks are written out as
+// series are added, the index once the block is closed.
+type BlockWriter struct {
+	dir  string
+	tmp  string
+	meta BlockMeta
+
+	segment     *os.File
+	segmentSeq  int
+	segmentSize int64
+
+	series map[string]*writtenSeries
+}
+
+// writtenSeries is a series added to a block and its chunks
+type writtenSeries struct {
+	labels []*prompb.Label
+	chunks []chunkMeta
+}
+
+type chunkMeta struct {
+	ref        uint64
+	mint, maxt int64
+}
+
+// NewBlockWriter starts a block to be created in the directory dir
+func NewBlockWriter(dir string) (*BlockWriter, error) {
+	ulid, err := newULID(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	w := &BlockWriter{
+		dir:    dir,
+		tmp:    filepath.Join(dir, ulid+".tmp"),
+		series: make(map[string]*writtenSeries),
+	}
+	w.meta.ULID = ulid
+	w.meta.MinTime, w.meta.MaxTime = math.MaxInt64, math.MinInt64
+	w.meta.Compaction.Level = 1
+	w.meta.Compaction.Sources = []string{ulid}
+	w.meta.Version = 1
+	if err := os.MkdirAll(filepath.Join(w.tmp, "chunks"), 0755); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Add writes the samples of a series, which must be in timestamp order and
+// after any samples added for the series before
+func (w *BlockWriter) Add(labels []*prompb.Label, samples []prompb.Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	labels = sortedLabels(labels)
+	key := labelsKey(labels)
+	s, ok := w.series[key]
+	if !ok {
+		s = &writtenSeries{labels: labels}
+		w.series[key] = s
+	}
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > maxChunkSamples {
+			n = maxChunkSamples
+		}
+		ref, err := w.writeChunk(encodeXOR(samples[:n]))
+		if err != nil {
+			return err
+		}
+		s.chunks = append(s.chunks, chunkMeta{
+			ref:  ref,
+			mint: samples[0].Timestamp,
+			maxt: samples[n-1].Timestamp,
+		})
+		if samples[0].Timestamp < w.meta.MinTime {
+			w.meta.MinTime = samples[0].Timestamp
+		}
+		if samples[n-1].Timestamp >= w.meta.MaxTime {
+			w.meta.MaxTime = samples[n-1].Timestamp + 1
+		}
+		w.meta.Stats.NumSamples += uint64(n)
+		w.meta.Stats.NumChunks++
+		samples = samples[n:]
+	}
+	return nil
+}
+
+// writeChunk appends a chunk to the current segment, cutting a new one when
+// it is full, and returns the reference of the chunk
+func (w *BlockWriter) writeChunk(data []byte) (uint64, error) {
+	var buf []byte
+	buf = putUvarint(buf, uint64(len(data)))
+	start := len(buf)
+	buf = append(buf, encodingXOR)
+	buf = append(buf, data...)
+	buf = putBE32(buf, crc32.Checksum(buf[start:], castagnoli))
+
+	if w.segment == nil || w.segmentSize+int64(len(buf)) > maxSegmentSize {
+		if err := w.cutSegment(); err != nil {
+			return 0, err
+		}
+	}
+	ref := uint64(w.segmentSeq-1)<<32 | uint64(w.segmentSize)
+	if _, err := w.segment.Write(buf); err != nil {
+		return 0, err
+	}
+	w.segmentSize += int64(len(buf))
+	return ref, nil
+}
+
+func (w *BlockWriter) cutSegment() error {
+	if w.segment != nil {
+		if err := w.segment.Close(); err != nil {
+			return err
+		}
+	}
+	w.segmentSeq++
+	f, err := os.Create(filepath.Join(w.tmp, "chunks", fmt.Sprintf("%06d", w.segmentSeq)))
+	if err != nil {
+		return err
+	}
+	header := putBE32(nil, chunksMagic)
+	header = append(header, 1, 0, 0, 0)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+	w.segment = f
+	w.segmentSize = chunksHeader
+	return nil
+}
+
+// Close writes the index and meta.json and moves the block into place,
+// returning its directory.  A block without series is discarded, and the
+// returned directory empty.
+func (w *BlockWriter) Close() (string, error) {
+	if w.segment != nil {
+		if err := w.segment.Close(); err != nil {
+			return "", err
+		}
+	}
+	if len(w.series) == 0 {
+		return "", os.RemoveAll(w.tmp)
+	}
+	w.meta.Stats.NumSeries = uint64(len(w.series))
+	if err := ioutil.WriteFile(filepath.Join(w.tmp, "index"), w.index(), 0644); err != nil {
+		return "", err
+	}
+	meta, err := json.MarshalIndent(w.meta, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.tmp, "meta.json"), meta, 0644); err != nil {
+		return "", err
+	}
+	tombstones := putBE32(nil, tombstonesMagic)
+	tombstones = append(tombstones, 1)
+	tombstones = putBE32(tombstones, crc32.Checksum(nil, castagnoli))
+	if err := ioutil.WriteFile(filepath.Join(w.tmp, "tombstones"), tombstones, 0644); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(w.dir, w.meta.ULID)
+	return dir, os.Rename(w.tmp, dir)
+}
+
+// index builds a version 2 index of the series, which are sorted by their
+// label sets and referenced by their offset divided by 16
+func (w *BlockWriter) index() []byte {
+	series := make([]*writtenSeries, 0, len(w.series))
+	symbolSet := make(map[string]struct{})
+	for _, s := range w.series {
+		series = append(series, s)
+		for _, l := range s.labels {
+			symbolSet[l.Name] = struct{}{}
+			symbolSet[l.Value] = struct{}{}
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return compareLabels(series[i].labels, series[j].labels) < 0
+	})
+	symbols := make([]string, 0, len(symbolSet))
+	for s := range symbolSet {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+	symbolRefs := make(map[string]uint64, len(symbols))
+	for i, s := range symbols {
+		symbolRefs[s] = uint64(i)
+	}
+
+	b := putBE32(nil, indexMagic)
+	b = append(b, indexV2)
+	var toc [6]uint64
+
+	toc[0] = uint64(len(b))
+	section := putBE32(nil, uint32(len(symbols)))
+	for _, s := range symbols {
+		section = putUvarintStr(section, s)
+	}
+	b = appendSection(b, section)
+
+	// postings of every label pair, the all postings key "" "" included
+	postings := map[string]map[string][]uint32{"": {"": nil}}
+	b = pad(b, 16)
+	toc[1] = uint64(len(b))
+	for _, s := range series {
+		b = pad(b, 16)
+		ref := uint32(len(b) / 16)
+		postings[""][""] = append(postings[""][""], ref)
+		var entry []byte
+		entry = putUvarint(entry, uint64(len(s.labels)))
+		for _, l := range s.labels {
+			entry = putUvarint(entry, symbolRefs[l.Name])
+			entry = putUvarint(entry, symbolRefs[l.Value])
+			if postings[l.Name] == nil {
+				postings[l.Name] = make(map[string][]uint32)
+			}
+			postings[l.Name][l.Value] = append(postings[l.Name][l.Value], ref)
+		}
+		entry = putUvarint(entry, uint64(len(s.chunks)))
+		for i, c := range s.chunks {
+			if i == 0 {
+				entry = putVarint(entry, c.mint)
+				entry = putUvarint(entry, uint64(c.maxt-c.mint))
+				entry = putUvarint(entry, c.ref)
+				continue
+			}
+			prev := s.chunks[i-1]
+			entry = putUvarint(entry, uint64(c.mint-prev.maxt))
+			entry = putUvarint(entry, uint64(c.maxt-c.mint))
+			entry = putVarint(entry, int64(c.ref)-int64(prev.ref))
+		}
+		b = putUvarint(b, uint64(len(entry)))
+		b = append(b, entry...)
+		b = putBE32(b, crc32.Checksum(entry, castagnoli))
+	}
+
+	names := make([]string, 0, len(postings))
+	for name := range postings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// label indices list the values of each label name
+	labelOffsets := make(map[string]uint64)
+	b = pad(b, 4)
+	toc[2] = uint64(len(b))
+	for _, name := range names[1:] {
+		values := sortedKeys(postings[name])
+		b = pad(b, 4)
+		labelOffsets[name] = uint64(len(b))
+		section := putBE32(nil, 1)
+		section = putBE32(section, uint32(len(values)))
+		for _, v := range values {
+			section = putBE32(section, uint32(symbolRefs[v]))
+		}
+		b = appendSection(b, section)
+	}
+
+	postingsOffsets := putBE32(nil, 0)
+	var numPostings uint32
+	b = pad(b, 4)
+	toc[4] = uint64(len(b))
+	for _, name := range names {
+		for _, value := range sortedKeys(postings[name]) {
+			b = pad(b, 4)
+			postingsOffsets = putUvarint(postingsOffsets, 2)
+			postingsOffsets = putUvarintStr(postingsOffsets, name)
+			postingsOffsets = putUvarintStr(postingsOffsets, value)
+			postingsOffsets = putUvarint(postingsOffsets, uint64(len(b)))
+			numPostings++
+			refs := postings[name][value]
+			section := putBE32(nil, uint32(len(refs)))
+			for _, ref := range refs {
+				section = putBE32(section, ref)
+			}
+			b = appendSection(b, section)
+		}
+	}
+	binary.BigEndian.PutUint32(postingsOffsets, numPostings)
+
+	toc[3] = uint64(len(b))
+	section = putBE32(nil, uint32(len(names)-1))
+	for _, name := range names[1:] {
+		section = putUvarint(section, 1)
+		section = putUvarintStr(section, name)
+		section = putUvarint(section, labelOffsets[name])
+	}
+	b = appendSection(b, section)
+
+	toc[5] = uint64(len(b))
+	b = appendSection(b, postingsOffsets)
+
+	start := len(b)
+	for _, off := range toc {
+		b = putBE64(b, off)
+	}
+	return putBE32(b, crc32.Checksum(b[start:], castagnoli))
+}
+
+// appendSection appends the length, content and checksum of an index section
+func appendSection(b, section []byte) []byte {
+	b = putBE32(b, uint32(len(section)))
+	b = append(b, section...)
+	return putBE32(b, crc32.Checksum(section, castagnoli))
+}
+
+func pad(b []byte, align int) []byte {
+	for len(b)%align != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func putBE32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func putBE64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func putUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func putVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func putUvarintStr(b []byte, s string) []byte {
+	b = putUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func sortedKeys(m map[string][]uint32) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedLabels returns labels ordered by name, as blocks store them
+func sortedLabels(labels []*prompb.Label) []*prompb.Label {
+	sorted := make([]*prompb.Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+func labelsKey(labels []*prompb.Label) string {
+	var key strings.Builder
+	for _, l := range labels {
+		key.WriteString(l.Name)
+		key.WriteByte(0xff)
+		key.WriteString(l.Value)
+		key.WriteByte(0xff)
+	}
+	return key.String()
+}
+
+// compareLabels orders label sets by their names and values in turn
+func compareLabels(a, b []*prompb.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// crockford is the alphabet of ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID, the millisecond timestamp followed by 80 random
+// bits, used by Prometheus to name blocks
+func newULID(t time.Time) (string, error) {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(t.UnixNano()/int64(time.Millisecond))<<16)
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	n := new(big.Int).SetBytes(id[:])
+	mask := big.NewInt(31)
+	var s [26]byte
+	for i := len(s) - 1; i >= 0; i-- {
+		s[i] = crockford[new(big.Int).And(n, mask).Int64()]
+		n.Rsh(n, 5)
+	}
+	return string(s[:]), nil
+}
@@ -0,0 +1,183 @@
+package tsdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tsdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBlockWriterFixture(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := NewBlockWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// labels in any order, the samples of a series added in two parts
+	labels := func(name string) []*prompb.Label {
+		return []*prompb.Label{
+			{Name: "job", Value: "node"},
+			{Name: "__name__", Value: name},
+			{Name: "instance", Value: "host:9100"},
+		}
+	}
+	adds := []struct {
+		name    string
+		samples []prompb.Sample
+	}{
+		{"node_load1", []prompb.Sample{{Timestamp: 1000, Value: 0.5}, {Timestamp: 16000, Value: 0.75}, {Timestamp: 31000, Value: 0.75}, {Timestamp: 46000, Value: 1.25}}},
+		{"node_load1", []prompb.Sample{{Timestamp: 61000, Value: 2}, {Timestamp: 76000, Value: math.Float64frombits(staleNaNBits)}}},
+		{"up", []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 16000, Value: 1}, {Timestamp: 31000, Value: 0}, {Timestamp: 46500, Value: 1}}},
+	}
+	for _, add := range adds {
+		if err := w.Add(labels(add.name), add.samples); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{"index", filepath.Join("chunks", "000001"), "tombstones"} {
+		got, err := ioutil.ReadFile(filepath.Join(block, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadFile(filepath.Join(fixtureBlock, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from the fixture", file)
+		}
+	}
+}
+
+func TestBlockWriterRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := NewBlockWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written in reverse, so the index must sort them
+	const numSeries = 50
+	want := make(map[string][]prompb.Sample)
+	var samples uint64
+	for i := numSeries - 1; i >= 0; i-- {
+		labels := []*prompb.Label{
+			{Name: "__name__", Value: "requests_total"},
+			{Name: "instance", Value: fmt.Sprintf("host-%02d", i)},
+		}
+		// enough samples for several chunks, with irregular intervals
+		var series []prompb.Sample
+		for j := 0; j < 100+i*5; j++ {
+			series = append(series, prompb.Sample{
+				Timestamp: int64(j*15000 + j%7*13),
+				Value:     float64(i*j) / 3,
+			})
+		}
+		series = append(series, prompb.Sample{
+			Timestamp: series[len(series)-1].Timestamp + 15000,
+			Value:     math.Float64frombits(staleNaNBits),
+		})
+		if err := w.Add(labels, series); err != nil {
+			t.Fatal(err)
+		}
+		want[labels[1].Value] = series
+		samples += uint64(len(series))
+	}
+	block, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsBlock(block) {
+		t.Fatalf("%s is not a block", block)
+	}
+
+	b, err := OpenBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.Meta.ULID != filepath.Base(block) || len(b.Meta.ULID) != 26 {
+		t.Errorf("unexpected ULID %s of block %s", b.Meta.ULID, block)
+	}
+	if b.Meta.Stats.NumSeries != numSeries || b.Meta.Stats.NumSamples != samples {
+		t.Errorf("unexpected stats %+v", b.Meta.Stats)
+	}
+	if b.Meta.MinTime != 0 {
+		t.Errorf("got min time %d, want 0", b.Meta.MinTime)
+	}
+
+	var prev string
+	err = b.ForEachSeries(0, func(i int, s *Series) error {
+		instance := s.Labels[1].Value
+		if instance <= prev {
+			t.Errorf("series %d: %s after %s", i, instance, prev)
+		}
+		prev = instance
+		var got []prompb.Sample
+		for _, ref := range s.Chunks {
+			chunk, err := b.Samples(ref)
+			if err != nil {
+				return err
+			}
+			if len(chunk) > maxChunkSamples {
+				t.Errorf("series %d: chunk of %d samples", i, len(chunk))
+			}
+			got = append(got, chunk...)
+		}
+		sameSamples(t, got, want[instance])
+		delete(want, instance)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) > 0 {
+		t.Errorf("%d series missing from the block", len(want))
+	}
+}
+
+func TestBlockWriterEmpty(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := NewBlockWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add([]*prompb.Label{{Name: "__name__", Value: "up"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	block, err := w.Close()
+	if err != nil || block != "" {
+		t.Fatalf("got %q, %v, want the block discarded", block, err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d entries left behind", len(entries))
+	}
+}